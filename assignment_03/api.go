@@ -0,0 +1,474 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/geo/s2"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+// the outputs of the image searches
+const (
+	outputJSON    = "json"
+	outputGeoJSON = "geojson"
+)
+
+// imagesResponse is the body returned by the /v1 image searches
+type imagesResponse struct {
+	Mgrs string `json:"mgrs,omitempty"`
+	// Tiles are the mgrs tiles of the scenes covering the point
+	Tiles  []string `json:"tiles,omitempty"`
+	Count  int      `json:"count"`
+	Images []string `json:"images"`
+}
+
+// polyResponse is the body returned by the /v1 polygon search
+type polyResponse struct {
+	Region  string  `json:"region"`
+	Country string  `json:"country"`
+	Count   int     `json:"count"`
+	Scenes  []scene `json:"scenes"`
+	// Covering holds the cell tokens of the covering of the polygon,
+	// if asked for with covering=true
+	Covering []string `json:"covering,omitempty"`
+}
+
+// scenesResponse is the body returned by the /v1 searches of scenes
+type scenesResponse struct {
+	Count  int     `json:"count"`
+	Scenes []scene `json:"scenes"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeJSON writes v as the json body of the response with the given status.
+// Like safeMarshalJSON it unescapes html characters, since the urls we return
+// are full of ampersands.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	writeJSONAs(w, status, "application/json", v)
+}
+
+// writeJSONAs is writeJSON with a more specific json content type, like
+// application/geo+json
+func writeJSONAs(w http.ResponseWriter, status int, contentType string, v interface{}) {
+	arr, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	arr = bytes.Replace(arr, []byte("\\u003c"), []byte("<"), -1)
+	arr = bytes.Replace(arr, []byte("\\u003e"), []byte(">"), -1)
+	arr = bytes.Replace(arr, []byte("\\u0026"), []byte("&"), -1)
+
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(arr)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, errorResponse{Error: fmt.Sprintf(format, args...)})
+}
+
+// loadPolygon returns the rings of the polygon of the country in the region,
+// along with the status to respond with if it cannot be loaded. Failures of
+// Geofabrik are those of an upstream, while a file of the library which
+// cannot be read or parsed is a failure of the app.
+func loadPolygon(ctx context.Context, region, country string) ([][]s2.Point, int, error) {
+	if err := validatePolyName(region, country); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	poly, err := polygonSource.Poly(ctx, region, country)
+	if err == errPolygonNotFound {
+		return nil, http.StatusNotFound, err
+	}
+	var polygons [][]s2.Point
+	if err == nil {
+		polygons, err = poly.Loops()
+	}
+	if err != nil {
+		logger.Errorf(ctx, "Failed to load polygon %s/%s: %v", region, country, err)
+		if _, ok := err.(geofabrikError); ok {
+			return nil, http.StatusBadGateway, err
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+	return polygons, http.StatusOK, nil
+}
+
+// searchFailed logs and reports an error of the search backend
+func searchFailed(ctx context.Context, w http.ResponseWriter, err error) {
+	logger.Errorf(ctx, "Search failed: %v", err)
+	writeError(w, http.StatusBadGateway, "search failed: %v", err)
+}
+
+// deprecated wraps a legacy handler, announcing its /v1 successor in the
+// Deprecation and Link headers of every response
+func deprecated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("</v1%s>; rel=\"successor-version\"", r.URL.Path))
+		handler(w, r)
+	}
+}
+
+// baseURL returns the scheme and host the request was made to, for the
+// absolute links of feeds. Behind a proxy the scheme is taken from the
+// X-Forwarded-Proto header.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// parseOutput reads the output parameter of the image searches, json (the
+// default) or geojson for a FeatureCollection of the footprints of the scenes
+func parseOutput(r *http.Request) (string, error) {
+	switch output := r.FormValue("output"); output {
+	case "", outputJSON:
+		return outputJSON, nil
+	case outputGeoJSON:
+		return output, nil
+	default:
+		return "", fmt.Errorf("bad output %q, expected %s or %s", output, outputJSON, outputGeoJSON)
+	}
+}
+
+// writeFootprints writes the footprints of the scenes as GeoJSON, with the
+// image files of each scene
+func writeFootprints(ctx context.Context, w http.ResponseWriter, scenes []scene) {
+	files := make(map[string][]string)
+	getImageUrlsWithProgress(ctx, sceneUrls(scenes), func(directory string, urls []string) {
+		files[directory] = urls
+	})
+	writeJSONAs(w, http.StatusOK, "application/geo+json", footprintCollectionOf(scenes, files))
+}
+
+// parseFloatParam parses the named form value as a float64
+func parseFloatParam(r *http.Request, name string) (float64, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return 0, fmt.Errorf("missing parameter %s", name)
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	// NaN would pass every range check
+	if err != nil || math.IsNaN(f) {
+		return 0, fmt.Errorf("bad parameter %s: %q", name, value)
+	}
+	return f, nil
+}
+
+// parseBBox parses a comma separated bbox parameter, which is checked by bboxRect
+func parseBBox(value string) ([]float64, error) {
+	if value == "" {
+		return nil, nil
+	}
+	bbox := make([]float64, 0, 4)
+	for _, coord := range strings.Split(value, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(coord), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad parameter bbox: %q", value)
+		}
+		bbox = append(bbox, f)
+	}
+	return bbox, nil
+}
+
+// bboxRect returns the rectangle of a GeoJSON bbox, given as west, south,
+// east, north, or with elevations after south and north, which are ignored.
+// A bbox with west greater than east crosses the antimeridian.
+func bboxRect(bbox []float64) (s2.Rect, error) {
+	if len(bbox) == 6 {
+		bbox = []float64{bbox[0], bbox[1], bbox[3], bbox[4]}
+	}
+	if len(bbox) != 4 || bbox[1] > bbox[3] || bbox[1] < -90 || bbox[3] > 90 ||
+		bbox[0] < -180 || bbox[0] > 180 || bbox[2] < -180 || bbox[2] > 180 {
+		return s2.Rect{}, fmt.Errorf("bad bbox %v, expected west, south, east, north", bbox)
+	}
+	return rectFromArea(bbox[3], bbox[1], bbox[2], bbox[0]), nil
+}
+
+// parseInterval parses a datetime parameter of STAC and OGC API searches,
+// a time or an interval of two times separated by a slash, either of which
+// may be open as ".." or empty, into the inclusive range of times it
+// matches, with zero times for open ends
+func parseInterval(value string) (from, to time.Time, err error) {
+	if value == "" {
+		return from, to, nil
+	}
+	parts := strings.Split(value, "/")
+	if len(parts) > 2 {
+		return from, to, fmt.Errorf("bad datetime %q", value)
+	}
+	times := make([]time.Time, len(parts))
+	for i, part := range parts {
+		if part == "" || part == ".." {
+			if len(parts) == 1 {
+				return from, to, fmt.Errorf("bad datetime %q", value)
+			}
+			continue
+		}
+		if times[i], err = time.Parse(time.RFC3339, part); err != nil {
+			return from, to, fmt.Errorf("bad datetime %q, expected RFC 3339 times", value)
+		}
+	}
+	if len(times) == 1 {
+		return times[0], times[0], nil
+	}
+	if !times[0].IsZero() && !times[1].IsZero() && times[1].Before(times[0]) {
+		return from, to, fmt.Errorf("bad datetime %q, the end is before the start", value)
+	}
+	return times[0], times[1], nil
+}
+
+// paramStatus is the status to respond with to parameters failing to parse
+// with err: bad gateway if geocoding an address failed, bad request otherwise
+func paramStatus(err error) int {
+	if _, ok := err.(geocodeError); ok {
+		return http.StatusBadGateway
+	}
+	return http.StatusBadRequest
+}
+
+// parsePoint reads the point of a request, given either as an address
+// which is geocoded or as lat and lng parameters. Either must be within
+// the MGRS grid.
+func parsePoint(ctx context.Context, r *http.Request) (lat, lng float64, err error) {
+	if address := r.FormValue("address"); address != "" {
+		lat, lng, err = getLatLngFromAddress(ctx, address)
+	} else if lat, err = parseFloatParam(r, "lat"); err == nil {
+		lng, err = parseFloatParam(r, "lng")
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if lat < -80 || lat > 84 || lng < -180 || lng > 180 {
+		return 0, 0, fmt.Errorf("point %f,%f is outside the MGRS grid", lat, lng)
+	}
+	return lat, lng, nil
+}
+
+// parseArea reads the bounding box of a request as north_lat, south_lat,
+// east_lng and west_lng parameters, within ±90 and ±180 degrees
+func parseArea(r *http.Request) (northLat, southLat, eastLng, westLng float64, err error) {
+	params := []struct {
+		name  string
+		value *float64
+		max   float64
+	}{
+		{"north_lat", &northLat, 90},
+		{"south_lat", &southLat, 90},
+		{"east_lng", &eastLng, 180},
+		{"west_lng", &westLng, 180},
+	}
+	for _, param := range params {
+		if *param.value, err = parseFloatParam(r, param.name); err != nil {
+			return
+		}
+		if *param.value < -param.max || *param.value > param.max {
+			err = fmt.Errorf("bad parameter %s: %f is not within ±%.0f degrees", param.name, *param.value, param.max)
+			return
+		}
+	}
+	if southLat > northLat {
+		err = fmt.Errorf("south_lat %f is north of north_lat %f", southLat, northLat)
+	}
+	return
+}
+
+func imageHandlerV1(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(newContext(r), config.Timeout)
+	defer cancel()
+
+	output, err := parseOutput(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	lat, lng, err := parsePoint(ctx, r)
+	if err != nil {
+		writeError(w, paramStatus(err), "%v", err)
+		return
+	}
+
+	scenes, err := getScenesAtPoint(ctx, lat, lng, sceneFilter{})
+	if err != nil {
+		searchFailed(ctx, w, err)
+		return
+	}
+	if output == outputGeoJSON {
+		writeFootprints(ctx, w, scenes)
+		return
+	}
+	imageUrls := getImageUrls(ctx, sceneUrls(scenes))
+	writeJSON(w, http.StatusOK, imagesResponse{
+		Mgrs:   GetMgrsFromCoords(lat, lng),
+		Tiles:  sceneTiles(scenes),
+		Count:  len(imageUrls),
+		Images: imageUrls,
+	})
+}
+
+func areaHandlerV1(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(newContext(r), config.Timeout)
+	defer cancel()
+
+	output, err := parseOutput(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	northLat, southLat, eastLng, westLng, err := parseArea(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	scenes, err := getScenesWithinArea(ctx, northLat, southLat, eastLng, westLng, sceneFilter{})
+	if err != nil {
+		searchFailed(ctx, w, err)
+		return
+	}
+	if output == outputGeoJSON {
+		writeFootprints(ctx, w, scenes)
+		return
+	}
+	imageUrls := getImageUrls(ctx, sceneUrls(scenes))
+	writeJSON(w, http.StatusOK, imagesResponse{Count: len(imageUrls), Images: imageUrls})
+}
+
+func polyHandlerV1(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(newContext(r), config.Timeout)
+	defer cancel()
+
+	vars := mux.Vars(r)
+	region, country := vars["region"], vars["country"]
+
+	opts, err := parseCoverOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	output, err := parseOutput(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	polygons, status, err := loadPolygon(ctx, region, country)
+	if err != nil {
+		writeError(w, status, "%s/%s: %v", region, country, err)
+		return
+	}
+	var covering []string
+	if r.FormValue("covering") == "true" {
+		cells, err := CellsFromPolygons(polygons, opts)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		covering = cellTokens(cells)
+	}
+	scenes, err := getScenesInPolygon(ctx, PolygonFromPoints(polygons), sceneFilter{})
+	if err != nil {
+		searchFailed(ctx, w, err)
+		return
+	}
+	if output == outputGeoJSON {
+		writeFootprints(ctx, w, scenes)
+		return
+	}
+
+	response := polyResponse{
+		Region:   region,
+		Country:  country,
+		Count:    len(scenes),
+		Scenes:   scenes,
+		Covering: covering,
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// maxPolygonSize limits the size of polygons posted to the app
+const maxPolygonSize = 10 << 20
+
+// polygonParsers are the parsers of posted polygons by their content type
+var polygonParsers = map[string]func(io.Reader) ([][]s2.Point, error){
+	"application/geo+json":                 ParseGeoJSON,
+	"application/json":                     ParseGeoJSON,
+	"application/wkt":                      ParseWKT,
+	"text/plain":                           ParseWKT,
+	"application/vnd.google-earth.kml+xml": ParseKML,
+	"application/xml":                      ParseKML,
+	"text/xml":                             ParseKML,
+}
+
+// parsePostedPolygon parses the polygon in the body of the request, in the
+// format given by its content type. Bodies without a type are read as GeoJSON.
+func parsePostedPolygon(w http.ResponseWriter, r *http.Request) ([][]s2.Point, int, error) {
+	mediaType := "application/json"
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+	parse, ok := polygonParsers[mediaType]
+	if !ok {
+		return nil, http.StatusUnsupportedMediaType,
+			fmt.Errorf("unsupported content type %q, expected GeoJSON, WKT or KML", mediaType)
+	}
+
+	polygons, err := parse(http.MaxBytesReader(w, r.Body, maxPolygonSize))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return polygons, http.StatusOK, nil
+}
+
+// polygonHandlerV1 returns the scenes intersecting a posted polygon
+func polygonHandlerV1(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(newContext(r), config.Timeout)
+	defer cancel()
+
+	polygons, status, err := parsePostedPolygon(w, r)
+	if err != nil {
+		writeError(w, status, "%v", err)
+		return
+	}
+
+	scenes, err := getScenesInPolygon(ctx, PolygonFromPoints(polygons), sceneFilter{})
+	if err != nil {
+		searchFailed(ctx, w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, scenesResponse{Count: len(scenes), Scenes: scenes})
+}
+
+// regionsHandlerV1 lists the countries with polygons, by region
+func regionsHandlerV1(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+	regions, err := polygonSource.Regions(ctx)
+	if err != nil {
+		logger.Errorf(ctx, "Failed to list regions: %v", err)
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]map[string][]string{"regions": regions})
+}
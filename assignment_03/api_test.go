@@ -0,0 +1,103 @@
+package app
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestParseArea(t *testing.T) {
+	tests := []struct {
+		query string
+		ok    bool
+	}{
+		{"north_lat=56&south_lat=55&east_lng=10&west_lng=9", true},
+		{"north_lat=90&south_lat=-90&east_lng=180&west_lng=-180", true},
+		{"north_lat=91&south_lat=55&east_lng=10&west_lng=9", false},
+		{"north_lat=56&south_lat=-95&east_lng=10&west_lng=9", false},
+		{"north_lat=56&south_lat=55&east_lng=190&west_lng=9", false},
+		{"north_lat=56&south_lat=55&east_lng=10&west_lng=-181", false},
+		{"north_lat=NaN&south_lat=55&east_lng=10&west_lng=9", false},
+		{"north_lat=55&south_lat=56&east_lng=10&west_lng=9", false},
+		{"north_lat=56&south_lat=55&east_lng=10", false},
+	}
+	for _, test := range tests {
+		_, _, _, _, err := parseArea(httptest.NewRequest(http.MethodGet, "/?"+test.query, nil))
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok %v", test.query, err, test.ok)
+		}
+	}
+}
+
+func TestCoverHandlerRejectsBadArea(t *testing.T) {
+	w := httptest.NewRecorder()
+	coverHandlerV1(w, httptest.NewRequest(http.MethodGet, "/v1/cover?north_lat=100&south_lat=55&east_lng=10&west_lng=9", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+}
+
+func TestLoadPolygonStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "polys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "europe"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"denmark": "denmark\n1\n   8 54\n   13 54\n   13 58\n   8 58\nEND\nEND\n",
+		"broken":  "broken\n1\n   8 54\n",
+		"bowtie":  "bowtie\n1\n   0 0\n   1 1\n   1 0\n   0 1\nEND\nEND\n",
+	}
+	for country, poly := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, "europe", country+".poly"), []byte(poly), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	geofabrik := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/asia/broken.poly":
+			io.WriteString(w, files["broken"])
+		case "/asia/bowtie.poly":
+			io.WriteString(w, files["bowtie"])
+		case "/asia/down.poly":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer geofabrik.Close()
+
+	saved := polygonSource
+	polygonSource = polygonSources{dirPolygonSource(dir), newGeofabrikSource(geofabrik.URL)}
+	defer func() { polygonSource = saved }()
+
+	tests := []struct {
+		region, country string
+		status          int
+	}{
+		{"europe", "denmark", http.StatusOK},
+		{"europe", "Denmark", http.StatusBadRequest},
+		{"europe", "sweden", http.StatusNotFound},
+		// files of the library are no upstream
+		{"europe", "broken", http.StatusInternalServerError},
+		{"europe", "bowtie", http.StatusInternalServerError},
+		{"asia", "broken", http.StatusBadGateway},
+		{"asia", "bowtie", http.StatusBadGateway},
+		{"asia", "down", http.StatusBadGateway},
+	}
+	for _, test := range tests {
+		_, status, err := loadPolygon(context.Background(), test.region, test.country)
+		if status != test.status {
+			t.Errorf("%s/%s: got status %d, want %d: %v", test.region, test.country, status, test.status, err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"net/http"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+)
+
+// The BigQuery client shared by all queries of the process. It is created
+// on first use from the config, unless injected with SetBigQueryClient.
+var (
+	bqMu     sync.Mutex
+	bqClient *bigquery.Client
+)
+
+type bigQueryKey struct{}
+
+// SetBigQueryClient injects the client shared by all queries of the process,
+// closing the client it replaces
+func SetBigQueryClient(c *bigquery.Client) {
+	bqMu.Lock()
+	defer bqMu.Unlock()
+	if bqClient != nil && bqClient != c {
+		bqClient.Close()
+	}
+	bqClient = c
+}
+
+// CloseBigQueryClient closes the shared client, if one was created
+func CloseBigQueryClient() error {
+	bqMu.Lock()
+	defer bqMu.Unlock()
+	if bqClient == nil {
+		return nil
+	}
+	err := bqClient.Close()
+	bqClient = nil
+	return err
+}
+
+// WithBigQueryClient returns a copy of ctx, whose queries use c
+// rather than the shared client
+func WithBigQueryClient(ctx context.Context, c *bigquery.Client) context.Context {
+	return context.WithValue(ctx, bigQueryKey{}, c)
+}
+
+// bigQueryClient returns the client to run the queries of ctx with
+func bigQueryClient(ctx context.Context) (*bigquery.Client, error) {
+	if c, ok := ctx.Value(bigQueryKey{}).(*bigquery.Client); ok {
+		return c, nil
+	}
+
+	bqMu.Lock()
+	defer bqMu.Unlock()
+	if bqClient == nil {
+		// the shared client outlives the request creating it
+		c, err := bigquery.NewClient(context.Background(), config.ProjectID, config.clientOptions()...)
+		if err != nil {
+			return nil, err
+		}
+		bqClient = c
+	}
+	return bqClient, nil
+}
+
+// checkBigQuery runs a trivial query, checking that the client of ctx
+// is able to reach BigQuery
+func checkBigQuery(ctx context.Context) error {
+	client, err := bigQueryClient(ctx)
+	if err != nil {
+		return err
+	}
+	it, err := client.Query("SELECT 1").Read(ctx)
+	if err != nil {
+		return err
+	}
+	var row []bigquery.Value
+	if err := it.Next(&row); err != nil && err != iterator.Done {
+		return err
+	}
+	return nil
+}
+
+// healthHandler reports whether the app is able to serve searches
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+	if idx := catalog(); idx != nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "scenes": len(idx.scenes)})
+		return
+	}
+	if err := checkBigQuery(ctx); err != nil {
+		logger.Errorf(ctx, "Health check failed: %v", err)
+		writeError(w, http.StatusServiceUnavailable, "bigquery: %v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,112 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/golang/geo/r1"
+	"github.com/golang/geo/s1"
+	"github.com/golang/geo/s2"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+// coverResponse is the body returned by /v1/cover
+type coverResponse struct {
+	Count  int      `json:"count"`
+	Tokens []string `json:"tokens"`
+}
+
+// rectFromArea returns the rectangle of a bounding box, which may cross
+// the antimeridian if west is east of east
+func rectFromArea(northLat, southLat, eastLng, westLng float64) s2.Rect {
+	degrees := func(d float64) float64 { return (s1.Angle(d) * s1.Degree).Radians() }
+	return s2.Rect{
+		Lat: r1.Interval{Lo: degrees(southLat), Hi: degrees(northLat)},
+		Lng: s1.IntervalFromEndpoints(degrees(westLng), degrees(eastLng)),
+	}
+}
+
+// cellHandlerV1 returns the scenes intersecting the s2 cell of the given token
+func cellHandlerV1(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(newContext(r), config.Timeout)
+	defer cancel()
+
+	token := mux.Vars(r)["token"]
+	id := s2.CellIDFromToken(token)
+	if !id.IsValid() {
+		writeError(w, http.StatusBadRequest, "bad cell token %q", token)
+		return
+	}
+
+	scenes, err := getScenesInPolygon(ctx, s2.PolygonFromCell(s2.CellFromCellID(id)), sceneFilter{})
+	if err != nil {
+		searchFailed(ctx, w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, scenesResponse{Count: len(scenes), Scenes: scenes})
+}
+
+// coverHandlerV1 returns the tokens of the covering of a posted polygon,
+// or of the bounding box given by the parameters of a GET request.
+// The covering is given by the options of parseCoverOptions, or all cells
+// of a single level with the level parameter.
+func coverHandlerV1(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseCoverOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	var region s2.Region
+	if r.Method == http.MethodPost {
+		polygons, status, err := parsePostedPolygon(w, r)
+		if err != nil {
+			writeError(w, status, "%v", err)
+			return
+		}
+		region = PolygonFromPoints(polygons)
+	} else {
+		northLat, southLat, eastLng, westLng, err := parseArea(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		if northLat == southLat || eastLng == westLng {
+			writeError(w, http.StatusBadRequest, "the bounding box has no area")
+			return
+		}
+		region = rectFromArea(northLat, southLat, eastLng, westLng)
+	}
+
+	if value := r.FormValue("level"); value != "" {
+		level, err := strconv.Atoi(value)
+		if err != nil || level < 0 || level > maxCellLevel {
+			writeError(w, http.StatusBadRequest, "bad parameter level: %q", value)
+			return
+		}
+		// refuse before computing coverings of more cells than we would return,
+		// counting the cells along the edges, which are most cells of thin areas
+		area, boundary := regionSize(region)
+		if cells := estimateCells(area, boundary, level); cells > maxCoverCells {
+			writeError(w, http.StatusBadRequest,
+				"level %d covers the area with about %.0f cells, more than the limit of %d", level, cells, maxCoverCells)
+			return
+		}
+		opts.MinLevel, opts.MaxLevel, opts.LevelMod, opts.MaxCells = level, level, 1, maxCoverCells
+	}
+	if err := opts.ValidateRegion(region); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	tokens := make([]string, 0)
+	for _, id := range opts.Cover(region) {
+		tokens = append(tokens, id.ToToken())
+	}
+	if len(tokens) > maxCoverCells {
+		writeError(w, http.StatusBadRequest, "covering has %d cells, more than the limit of %d", len(tokens), maxCoverCells)
+		return
+	}
+	writeJSON(w, http.StatusOK, coverResponse{Count: len(tokens), Tokens: tokens})
+}
@@ -0,0 +1,35 @@
+// +build !appengine
+
+// Command server runs the app as a standalone net/http server,
+// outside of App Engine.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	app "github.com/ecly/scalable_web_systems_assignments/assignment_03"
+)
+
+func main() {
+	app.RegisterConfigFlags(flag.CommandLine)
+	flag.Parse()
+
+	config, err := app.LoadConfig(os.Getenv("SWS_CONFIG"), flag.CommandLine)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := app.Configure(config); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Listening on %s (%s)", config.ListenAddr, config)
+	err = http.ListenAndServe(config.ListenAddr, app.NewRouter())
+	// ListenAndServe only returns on failure, which must end the process
+	// with a failing status for supervisors to notice
+	log.Print(err)
+	app.CloseBigQueryClient()
+	os.Exit(1)
+}
@@ -0,0 +1,413 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abiosoft/semaphore"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+)
+
+// Config holds everything that differs between deployments of the app.
+//
+// It is loaded by LoadConfig from, in increasing order of precedence,
+// the defaults, a json file, SWS_* environment variables and command line flags.
+// Secrets (the maps api key and the webhook secret) are only read from the
+// environment or a file and are never printed.
+type Config struct {
+	// ProjectID is the google cloud project billed for BigQuery
+	ProjectID string
+	// CredentialsFile is a service account key file, if not using
+	// the default credentials of the environment
+	CredentialsFile string
+	// MapsAPIKey is used to geocode addresses
+	MapsAPIKey string
+	// Backend selects where scenes are searched: "bigquery" queries the
+	// BigQuery index for every search, "index" searches an s2 cell index of
+	// all scenes in memory
+	Backend string
+	// IndexPath is the file the index of the index backend is kept in.
+	// It is built from BigQuery in the background if missing.
+	IndexPath string
+	// IndexBuildTimeout bounds the build of a missing index
+	IndexBuildTimeout time.Duration
+	// MaxConcurrentRequests limits the concurrent requests to the storage api
+	MaxConcurrentRequests int
+	// Timeout of each request to the app
+	Timeout time.Duration
+	// ListenAddr is the address the standalone server listens on
+	ListenAddr string
+	// PolyDir is a library of .poly files, as <region>/<country>.poly
+	PolyDir string
+	// GeofabrikFallback downloads polygons missing from the library
+	// from Geofabrik
+	GeofabrikFallback bool
+	// DownloadDir is a local stand-in for the sentinel 2 bucket, laid out
+	// like the bucket, which downloads are served from instead of GCS
+	DownloadDir string
+	// MaxExportSize limits the total size of the files of an export, in bytes
+	MaxExportSize int64
+	// JobRetention is how long finished jobs and their results are kept
+	JobRetention time.Duration
+	// JobStorePath is the file jobs are kept in, so they survive restarts.
+	// Without it jobs are kept in memory.
+	JobStorePath string
+	// WebhookSecret signs the callbacks of jobs
+	WebhookSecret string
+	// CallbackHosts are the only hosts, along with their subdomains, which
+	// the callbacks of jobs may be sent to, even at private addresses.
+	// Without them callbacks may be sent to any host at a public address.
+	CallbackHosts []string
+	// SubscriptionsPath is the directory subscriptions are kept in, a file
+	// each, so they survive restarts. Without it subscriptions are kept in
+	// memory.
+	SubscriptionsPath string
+	// SubscriptionInterval is how often subscriptions are re-run
+	SubscriptionInterval time.Duration
+}
+
+// the backends a Config can select
+const (
+	backendBigQuery = "bigquery"
+	backendIndex    = "index"
+)
+
+// fileConfig is the json representation of a Config file
+type fileConfig struct {
+	ProjectID             string   `json:"project_id"`
+	CredentialsFile       string   `json:"credentials_file"`
+	MapsAPIKeyFile        string   `json:"maps_api_key_file"`
+	Backend               string   `json:"backend"`
+	IndexPath             string   `json:"index_path"`
+	IndexBuildTimeout     string   `json:"index_build_timeout"`
+	MaxConcurrentRequests int      `json:"max_concurrent_requests"`
+	Timeout               string   `json:"timeout"`
+	ListenAddr            string   `json:"listen_addr"`
+	PolyDir               string   `json:"poly_dir"`
+	GeofabrikFallback     *bool    `json:"geofabrik_fallback"`
+	DownloadDir           string   `json:"download_dir"`
+	MaxExportSize         int64    `json:"max_export_size"`
+	JobRetention          string   `json:"job_retention"`
+	JobStorePath          string   `json:"job_store_path"`
+	WebhookSecretFile     string   `json:"webhook_secret_file"`
+	CallbackHosts         []string `json:"callback_hosts"`
+	SubscriptionsPath     string   `json:"subscriptions_path"`
+	SubscriptionInterval  string   `json:"subscription_interval"`
+}
+
+// config is the Config of the running app, set through Configure
+var config = DefaultConfig()
+
+// DefaultConfig returns the Config used when nothing else is given
+func DefaultConfig() *Config {
+	return &Config{
+		ProjectID:             os.Getenv("GOOGLE_CLOUD_PROJECT"),
+		Backend:               backendBigQuery,
+		MaxConcurrentRequests: 100,
+		IndexBuildTimeout:     time.Hour,
+		Timeout:               5 * time.Minute,
+		ListenAddr:            ":8080",
+		GeofabrikFallback:     true,
+		MaxExportSize:         10 << 30,
+		JobRetention:          24 * time.Hour,
+		SubscriptionInterval:  time.Hour,
+	}
+}
+
+// Configure makes c the Config of the app. It must be called before
+// serving any requests.
+func Configure(c *Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	config = c
+	sem = semaphore.New(c.MaxConcurrentRequests)
+	polygonSource = newPolygonSource(c)
+	objects = newObjectStore(c)
+
+	setCatalog(nil)
+	if c.Backend == backendIndex {
+		if err := loadSceneIndex(c.IndexPath, c.IndexBuildTimeout); err != nil {
+			return fmt.Errorf("config: failed to load scene index: %v", err)
+		}
+	}
+
+	var store JobStore = newMemoryJobStore()
+	if c.JobStorePath != "" {
+		var err error
+		if store, err = openJobStore(c.JobStorePath); err != nil {
+			return fmt.Errorf("config: failed to open job store: %v", err)
+		}
+	}
+	jobs = newJobRunner(store)
+	if err := jobs.resume(context.Background()); err != nil {
+		return fmt.Errorf("config: failed to resume jobs: %v", err)
+	}
+
+	subs, err := loadSubscriptions(c.SubscriptionsPath)
+	if err != nil {
+		return fmt.Errorf("config: failed to load subscriptions: %v", err)
+	}
+	subscriptions = subs
+	scheduleSubscriptions.Do(func() {
+		every(c.SubscriptionInterval, func(ctx context.Context) {
+			subscriptions.runAll(ctx)
+		})
+	})
+	return nil
+}
+
+// scheduleSubscriptions schedules the runs of the subscriptions once, at
+// the interval of the first Config
+var scheduleSubscriptions sync.Once
+
+// Validate reports whether the Config is usable
+func (c *Config) Validate() error {
+	switch c.Backend {
+	case backendBigQuery:
+		if c.ProjectID == "" {
+			return errors.New("config: the bigquery backend needs a project id")
+		}
+	case backendIndex:
+		if c.IndexPath == "" {
+			return errors.New("config: the index backend needs an index path")
+		}
+	default:
+		return fmt.Errorf("config: unknown backend %q", c.Backend)
+	}
+	if c.MaxConcurrentRequests < 1 {
+		return fmt.Errorf("config: max concurrent requests must be positive, got %d", c.MaxConcurrentRequests)
+	}
+	if c.IndexBuildTimeout <= 0 {
+		return fmt.Errorf("config: index build timeout must be positive, got %s", c.IndexBuildTimeout)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("config: timeout must be positive, got %s", c.Timeout)
+	}
+	if c.MaxExportSize < 1 {
+		return fmt.Errorf("config: max export size must be positive, got %d", c.MaxExportSize)
+	}
+	if c.JobRetention <= 0 {
+		return fmt.Errorf("config: job retention must be positive, got %s", c.JobRetention)
+	}
+	if c.SubscriptionInterval <= 0 {
+		return fmt.Errorf("config: subscription interval must be positive, got %s", c.SubscriptionInterval)
+	}
+	if c.PolyDir == "" && !c.GeofabrikFallback {
+		return errors.New("config: polygons need a poly dir or the geofabrik fallback")
+	}
+	return nil
+}
+
+// String describes the Config with its secrets redacted, so it is safe to log
+func (c Config) String() string {
+	redact := func(secret string) string {
+		if secret == "" {
+			return "unset"
+		}
+		return "redacted"
+	}
+	return fmt.Sprintf("project=%s credentials=%s maps_api_key=%s backend=%s "+
+		"max_concurrent_requests=%d timeout=%s listen_addr=%s poly_dir=%s geofabrik_fallback=%t index_path=%s "+
+		"index_build_timeout=%s download_dir=%s max_export_size=%d job_retention=%s job_store_path=%s "+
+		"webhook_secret=%s callback_hosts=%s subscriptions_path=%s subscription_interval=%s",
+		c.ProjectID, c.CredentialsFile, redact(c.MapsAPIKey), c.Backend,
+		c.MaxConcurrentRequests, c.Timeout, c.ListenAddr, c.PolyDir, c.GeofabrikFallback, c.IndexPath,
+		c.IndexBuildTimeout, c.DownloadDir, c.MaxExportSize, c.JobRetention, c.JobStorePath,
+		redact(c.WebhookSecret), strings.Join(c.CallbackHosts, ","), c.SubscriptionsPath, c.SubscriptionInterval)
+}
+
+// GoString keeps %#v from printing the secrets as well
+func (c Config) GoString() string {
+	return c.String()
+}
+
+// clientOptions are the options for google api clients given by the Config
+func (c *Config) clientOptions() []option.ClientOption {
+	if c.CredentialsFile == "" {
+		return nil
+	}
+	return []option.ClientOption{option.WithCredentialsFile(c.CredentialsFile)}
+}
+
+// RegisterConfigFlags defines the flags read by LoadConfig on fs.
+// There are deliberately no flags for the secrets themselves, as command
+// lines are visible to every user of the machine.
+func RegisterConfigFlags(fs *flag.FlagSet) {
+	fs.String("config", "", "json config file")
+	fs.String("project", "", "google cloud project id")
+	fs.String("credentials-file", "", "google service account key file")
+	fs.String("maps-api-key-file", "", "file containing the google maps api key")
+	fs.String("backend", "", "scene search backend ("+backendBigQuery+" or "+backendIndex+")")
+	fs.String("index-path", "", "scene index file of the index backend")
+	fs.String("index-build-timeout", "", "timeout of building a missing scene index, e.g. 1h")
+	fs.String("max-concurrent-requests", "", "limit of concurrent storage api requests")
+	fs.String("timeout", "", "timeout of each request, e.g. 5m")
+	fs.String("addr", "", "address to listen on")
+	fs.String("poly-dir", "", "library of .poly files, as <region>/<country>.poly")
+	fs.String("geofabrik-fallback", "", "download polygons missing from the library from geofabrik (true/false)")
+	fs.String("download-dir", "", "local stand-in for the sentinel 2 bucket to serve downloads from")
+	fs.String("max-export-size", "", "limit of the total size of the files of an export, in bytes")
+	fs.String("job-retention", "", "how long finished jobs are kept, e.g. 24h")
+	fs.String("job-store", "", "file to keep jobs in across restarts")
+	fs.String("webhook-secret-file", "", "file containing the secret signing job callbacks")
+	fs.String("callback-hosts", "", "comma separated hosts job callbacks may be sent to, instead of any public host")
+	fs.String("subscriptions", "", "directory to keep subscriptions in across restarts")
+	fs.String("subscription-interval", "", "how often subscriptions are re-run, e.g. 1h")
+}
+
+// LoadConfig loads the Config from the file at path (if not empty), the
+// environment and the flags set in fs (if not nil). A -config flag takes
+// precedence over path.
+func LoadConfig(path string, fs *flag.FlagSet) (*Config, error) {
+	flags := make(map[string]string)
+	if fs != nil {
+		fs.Visit(func(f *flag.Flag) {
+			flags[f.Name] = f.Value.String()
+		})
+	}
+	if p, ok := flags["config"]; ok {
+		path = p
+	}
+
+	c := DefaultConfig()
+	file := fileConfig{}
+	maxConcurrentRequests, geofabrikFallback, maxExportSize, callbackHosts := "", "", "", ""
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("config: %v", err)
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("config: %s: %v", path, err)
+		}
+		if file.MaxConcurrentRequests != 0 {
+			maxConcurrentRequests = strconv.Itoa(file.MaxConcurrentRequests)
+		}
+		if file.MaxExportSize != 0 {
+			maxExportSize = strconv.FormatInt(file.MaxExportSize, 10)
+		}
+		callbackHosts = strings.Join(file.CallbackHosts, ",")
+		if file.GeofabrikFallback != nil {
+			geofabrikFallback = strconv.FormatBool(*file.GeofabrikFallback)
+		}
+	}
+
+	// every setting as it is named in the file, the environment and the flags
+	settings := []struct {
+		file, env, flag string
+		set             func(string) error
+	}{
+		{file.ProjectID, "SWS_PROJECT_ID", "project", setString(&c.ProjectID)},
+		{file.CredentialsFile, "SWS_CREDENTIALS_FILE", "credentials-file", setString(&c.CredentialsFile)},
+		{file.MapsAPIKeyFile, "SWS_MAPS_API_KEY_FILE", "maps-api-key-file", readSecret(&c.MapsAPIKey)},
+		{"", "SWS_MAPS_API_KEY", "", setString(&c.MapsAPIKey)},
+		{file.Backend, "SWS_BACKEND", "backend", setString(&c.Backend)},
+		{file.IndexPath, "SWS_INDEX_PATH", "index-path", setString(&c.IndexPath)},
+		{file.IndexBuildTimeout, "SWS_INDEX_BUILD_TIMEOUT", "index-build-timeout", setDuration(&c.IndexBuildTimeout)},
+		{maxConcurrentRequests, "SWS_MAX_CONCURRENT_REQUESTS", "max-concurrent-requests", setInt(&c.MaxConcurrentRequests)},
+		{file.Timeout, "SWS_TIMEOUT", "timeout", setDuration(&c.Timeout)},
+		{file.ListenAddr, "SWS_LISTEN_ADDR", "addr", setString(&c.ListenAddr)},
+		{file.PolyDir, "SWS_POLY_DIR", "poly-dir", setString(&c.PolyDir)},
+		{geofabrikFallback, "SWS_GEOFABRIK_FALLBACK", "geofabrik-fallback", setBool(&c.GeofabrikFallback)},
+		{file.DownloadDir, "SWS_DOWNLOAD_DIR", "download-dir", setString(&c.DownloadDir)},
+		{maxExportSize, "SWS_MAX_EXPORT_SIZE", "max-export-size", setInt64(&c.MaxExportSize)},
+		{file.JobRetention, "SWS_JOB_RETENTION", "job-retention", setDuration(&c.JobRetention)},
+		{file.JobStorePath, "SWS_JOB_STORE_PATH", "job-store", setString(&c.JobStorePath)},
+		{file.WebhookSecretFile, "SWS_WEBHOOK_SECRET_FILE", "webhook-secret-file", readSecret(&c.WebhookSecret)},
+		{"", "SWS_WEBHOOK_SECRET", "", setString(&c.WebhookSecret)},
+		{callbackHosts, "SWS_CALLBACK_HOSTS", "callback-hosts", setList(&c.CallbackHosts)},
+		{file.SubscriptionsPath, "SWS_SUBSCRIPTIONS_PATH", "subscriptions", setString(&c.SubscriptionsPath)},
+		{file.SubscriptionInterval, "SWS_SUBSCRIPTION_INTERVAL", "subscription-interval", setDuration(&c.SubscriptionInterval)},
+	}
+	// the settings are applied a source at a time, so that a secret set in
+	// the environment wins over the file of the secret named in the config
+	// file, and a secret read from a file named by a flag wins over both.
+	// Within the environment a secret wins over the file of the secret.
+	sources := []func(file, env, flag string) string{
+		func(file, env, flag string) string { return file },
+		func(file, env, flag string) string { return os.Getenv(env) },
+		func(file, env, flag string) string { return flags[flag] },
+	}
+	for _, source := range sources {
+		for _, s := range settings {
+			v := source(s.file, s.env, s.flag)
+			if v == "" {
+				continue
+			}
+			if err := s.set(v); err != nil {
+				return nil, fmt.Errorf("config: %s: %v", s.env, err)
+			}
+		}
+	}
+	return c, nil
+}
+
+// readSecret sets dst to the contents of the file at the path it is given
+func readSecret(dst *string) func(string) error {
+	return func(path string) error {
+		secret, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		*dst = strings.TrimSpace(string(secret))
+		return nil
+	}
+}
+
+func setString(dst *string) func(string) error {
+	return func(v string) error {
+		*dst = v
+		return nil
+	}
+}
+
+// setList sets dst to the non-empty items of a comma separated list
+func setList(dst *[]string) func(string) error {
+	return func(v string) error {
+		*dst = nil
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*dst = append(*dst, item)
+			}
+		}
+		return nil
+	}
+}
+
+func setInt(dst *int) func(string) error {
+	return func(v string) (err error) {
+		*dst, err = strconv.Atoi(v)
+		return
+	}
+}
+
+func setInt64(dst *int64) func(string) error {
+	return func(v string) (err error) {
+		*dst, err = strconv.ParseInt(v, 10, 64)
+		return
+	}
+}
+
+func setBool(dst *bool) func(string) error {
+	return func(v string) (err error) {
+		*dst, err = strconv.ParseBool(v)
+		return
+	}
+}
+
+func setDuration(dst *time.Duration) func(string) error {
+	return func(v string) (err error) {
+		*dst, err = time.ParseDuration(v)
+		return
+	}
+}
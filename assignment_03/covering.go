@@ -0,0 +1,163 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/geo/s2"
+)
+
+// maxCellLevel is the level of the smallest s2 cells
+const maxCellLevel = 30
+
+// maxCoverCells bounds the MaxCells of a covering requested by clients,
+// as every cell of a covering costs a condition in the cell queries
+const maxCoverCells = 1000
+
+// CoverOptions are the parameters of the s2.RegionCoverer covering polygons
+type CoverOptions struct {
+	MinLevel int
+	MaxLevel int
+	MaxCells int
+	LevelMod int
+	// Interior covers only the cells entirely within the polygon,
+	// rather than all cells intersecting it
+	Interior bool
+}
+
+// DefaultCoverOptions returns the options used when none are given
+func DefaultCoverOptions() CoverOptions {
+	return CoverOptions{MinLevel: 0, MaxLevel: maxCellLevel, MaxCells: 10, LevelMod: 1}
+}
+
+// Validate reports whether the options are within the bounds of s2
+// and of what the app is willing to query
+func (o CoverOptions) Validate() error {
+	switch {
+	case o.MinLevel < 0 || o.MinLevel > maxCellLevel:
+		return fmt.Errorf("min_level %d is not within 0 and %d", o.MinLevel, maxCellLevel)
+	case o.MaxLevel < o.MinLevel || o.MaxLevel > maxCellLevel:
+		return fmt.Errorf("max_level %d is not within min_level %d and %d", o.MaxLevel, o.MinLevel, maxCellLevel)
+	case o.MaxCells < 1 || o.MaxCells > maxCoverCells:
+		return fmt.Errorf("max_cells %d is not within 1 and %d", o.MaxCells, maxCoverCells)
+	case o.LevelMod < 1 || o.LevelMod > 3:
+		return fmt.Errorf("level_mod %d is not within 1 and 3", o.LevelMod)
+	}
+	return nil
+}
+
+// ValidateRegion reports whether covering the region with the options is
+// within what the app is willing to compute. The covering has at least the
+// cells of MinLevel needed to cover the region, which grow about fourfold
+// with every level, so these are estimated before covering.
+func (o CoverOptions) ValidateRegion(region s2.Region) error {
+	area, boundary := regionSize(region)
+	if cells := estimateCells(area, boundary, o.MinLevel); cells > maxCoverCells {
+		return fmt.Errorf("min_level %d covers the region with about %.0f cells, more than the limit of %d",
+			o.MinLevel, cells, maxCoverCells)
+	}
+	return nil
+}
+
+// estimateCells estimates the number of cells of the given level covering
+// a region of the given area and boundary length, in steradians and radians:
+// the cells within the region, and those along its boundary, which are most
+// of the cells of thin regions
+func estimateCells(area, boundary float64, level int) float64 {
+	return area/s2.AvgAreaMetric.Value(level) + boundary/s2.AvgEdgeMetric.Value(level)
+}
+
+// regionSize returns the area and boundary length of a polygon or
+// rectangle, or those of the bounding cap of any other region
+func regionSize(region s2.Region) (float64, float64) {
+	switch region := region.(type) {
+	case *s2.Polygon:
+		boundary := 0.0
+		for _, loop := range region.Loops() {
+			for i := 0; i < loop.NumVertices(); i++ {
+				boundary += loop.Vertex(i).Distance(loop.Vertex(i + 1)).Radians()
+			}
+		}
+		return region.Area(), boundary
+	case s2.Rect:
+		// the sides along meridians, and the parallels shrinking with latitude
+		boundary := 2*region.Lat.Length() +
+			region.Lng.Length()*(math.Cos(region.Lat.Lo)+math.Cos(region.Lat.Hi))
+		return region.Area(), boundary
+	default:
+		c := region.CapBound()
+		return c.Area(), 2 * math.Pi * math.Sin(c.Radius().Radians())
+	}
+}
+
+// Cover returns the covering of the region given by the options
+func (o CoverOptions) Cover(region s2.Region) s2.CellUnion {
+	rc := &s2.RegionCoverer{
+		MinLevel: o.MinLevel,
+		MaxLevel: o.MaxLevel,
+		MaxCells: o.MaxCells,
+		LevelMod: o.LevelMod,
+	}
+	if o.Interior {
+		return rc.InteriorCovering(region)
+	}
+	return rc.Covering(region)
+}
+
+// parseCoverOptions reads the options of a covering from the min_level,
+// max_level, max_cells, level_mod and interior parameters of a request,
+// defaulting to DefaultCoverOptions
+func parseCoverOptions(r *http.Request) (CoverOptions, error) {
+	o := DefaultCoverOptions()
+	params := []struct {
+		name  string
+		value *int
+	}{
+		{"min_level", &o.MinLevel},
+		{"max_level", &o.MaxLevel},
+		{"max_cells", &o.MaxCells},
+		{"level_mod", &o.LevelMod},
+	}
+	for _, p := range params {
+		if value := r.FormValue(p.name); value != "" {
+			i, err := strconv.Atoi(value)
+			if err != nil {
+				return o, fmt.Errorf("bad parameter %s: %q", p.name, value)
+			}
+			*p.value = i
+		}
+	}
+	if value := r.FormValue("interior"); value != "" {
+		interior, err := strconv.ParseBool(value)
+		if err != nil {
+			return o, fmt.Errorf("bad parameter interior: %q", value)
+		}
+		o.Interior = interior
+	}
+	return o, o.Validate()
+}
+
+// CellsFromPolygons covers the polygon of the given rings, holes included,
+// with the given options, failing if the covering would be too large
+func CellsFromPolygons(polygons [][]s2.Point, opts CoverOptions) ([]s2.Cell, error) {
+	polygon := PolygonFromPoints(polygons)
+	if err := opts.ValidateRegion(polygon); err != nil {
+		return nil, err
+	}
+	cells := make([]s2.Cell, 0)
+	for _, cid := range opts.Cover(polygon) {
+		cells = append(cells, s2.CellFromCellID(cid))
+	}
+	return cells, nil
+}
+
+// cellTokens returns the tokens of the given cells
+func cellTokens(cells []s2.Cell) []string {
+	tokens := make([]string, 0, len(cells))
+	for _, cell := range cells {
+		tokens = append(tokens, cell.ID().ToToken())
+	}
+	return tokens
+}
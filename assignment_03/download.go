@@ -0,0 +1,375 @@
+package app
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+// sentinelBucket is the bucket of the public sentinel 2 data on GCS
+const sentinelBucket = "gcp-public-data-sentinel-2"
+
+var errObjectNotFound = errors.New("object not found")
+
+// objectInfo is the metadata of a stored object
+type objectInfo struct {
+	Size        int64
+	MD5         []byte
+	ETag        string
+	Updated     time.Time
+	ContentType string
+}
+
+// objectStore is the upstream granule files are downloaded from
+type objectStore interface {
+	// Stat returns the metadata of the named object, or errObjectNotFound
+	Stat(ctx context.Context, name string) (objectInfo, error)
+	// Read returns the contents of the named object from the given offset on
+	Read(ctx context.Context, name string, offset int64) (io.ReadCloser, error)
+}
+
+// objects is the objectStore of the app, set up by Configure
+var objects = newObjectStore(config)
+
+func newObjectStore(c *Config) objectStore {
+	if c.DownloadDir != "" {
+		return dirObjectStore(c.DownloadDir)
+	}
+	return gcsObjectStore{bucket: sentinelBucket}
+}
+
+// gcsObjectStore reads objects of a public bucket through the storage json api
+type gcsObjectStore struct {
+	bucket string
+}
+
+func (g gcsObjectStore) url(name string) string {
+	return fmt.Sprintf("https://www.googleapis.com/storage/v1/b/%s/o/%s", g.bucket, url.PathEscape(name))
+}
+
+func (g gcsObjectStore) get(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	res, err := httpClient(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return res, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, errObjectNotFound
+	default:
+		res.Body.Close()
+		return nil, fmt.Errorf("%s: %s", url, res.Status)
+	}
+}
+
+func (g gcsObjectStore) Stat(ctx context.Context, name string) (objectInfo, error) {
+	res, err := g.get(ctx, g.url(name), nil)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	defer res.Body.Close()
+
+	var metadata struct {
+		Size        int64 `json:",string"`
+		MD5Hash     string
+		ETag        string
+		Updated     time.Time
+		ContentType string
+	}
+	if err := json.NewDecoder(res.Body).Decode(&metadata); err != nil {
+		return objectInfo{}, err
+	}
+	sum, err := base64.StdEncoding.DecodeString(metadata.MD5Hash)
+	if err != nil {
+		return objectInfo{}, fmt.Errorf("bad md5Hash of %s: %v", name, err)
+	}
+	return objectInfo{
+		Size:        metadata.Size,
+		MD5:         sum,
+		ETag:        metadata.ETag,
+		Updated:     metadata.Updated,
+		ContentType: metadata.ContentType,
+	}, nil
+}
+
+func (g gcsObjectStore) Read(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := g.get(ctx, g.url(name)+"?alt=media", header)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 && res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, fmt.Errorf("range of %s not honoured", name)
+	}
+	return res.Body, nil
+}
+
+// dirObjectStore is a local stand-in for GCS, serving the objects of the
+// bucket from a directory laid out like the bucket
+type dirObjectStore string
+
+func (dir dirObjectStore) path(name string) string {
+	return filepath.Join(string(dir), filepath.FromSlash(name))
+}
+
+func (dir dirObjectStore) Stat(ctx context.Context, name string) (objectInfo, error) {
+	file, err := os.Open(dir.path(name))
+	if os.IsNotExist(err) {
+		return objectInfo{}, errObjectNotFound
+	}
+	if err != nil {
+		return objectInfo{}, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return objectInfo{}, err
+	}
+	sum, err := dirChecksums.sum(file, stat)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	return objectInfo{
+		Size:    stat.Size(),
+		MD5:     sum,
+		ETag:    base64.StdEncoding.EncodeToString(sum),
+		Updated: stat.ModTime(),
+	}, nil
+}
+
+// checksumCache keeps the md5 checksums of the files of dirObjectStores,
+// as unlike GCS a directory keeps none, and reading a whole file for every
+// download is as costly as the download itself. A checksum is computed again
+// once the size or modification time of its file changes.
+type checksumCache struct {
+	sync.Mutex
+	sums map[string]fileChecksum
+}
+
+type fileChecksum struct {
+	size    int64
+	modTime time.Time
+	md5     []byte
+}
+
+// maxChecksums bounds the number of checksums kept by a checksumCache
+const maxChecksums = 10000
+
+var dirChecksums = &checksumCache{sums: make(map[string]fileChecksum)}
+
+// sum returns the md5 checksum of the file with the given stat
+func (c *checksumCache) sum(file *os.File, stat os.FileInfo) ([]byte, error) {
+	c.Lock()
+	cached, ok := c.sums[file.Name()]
+	c.Unlock()
+	if ok && cached.size == stat.Size() && cached.modTime.Equal(stat.ModTime()) {
+		return cached.md5, nil
+	}
+
+	h := md5.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, err
+	}
+	sum := h.Sum(nil)
+
+	c.Lock()
+	defer c.Unlock()
+	if len(c.sums) >= maxChecksums {
+		c.sums = make(map[string]fileChecksum)
+	}
+	c.sums[file.Name()] = fileChecksum{size: stat.Size(), modTime: stat.ModTime(), md5: sum}
+	return sum, nil
+}
+
+func (dir dirObjectStore) Read(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(dir.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// objectReader reads an object of a store as an io.ReadSeeker, opening
+// the object at the current offset on the first read after every seek.
+// Reading the object from start to end verifies its md5 checksum, failing
+// the last read without returning its bytes if it does not match, so that
+// the object is never read completely. Closing it is safe while it is read
+// by another goroutine.
+type objectReader struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	store  objectStore
+	name   string
+	info   objectInfo
+	offset int64
+	body   io.ReadCloser
+	// hash is the md5 of what was read so far, while reading sequentially from the start
+	hash hash.Hash
+}
+
+var errChecksumMismatch = errors.New("md5 checksum mismatch")
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.body == nil {
+		body, err := o.store.Read(o.ctx, o.name, o.offset)
+		if err != nil {
+			return 0, err
+		}
+		o.body = body
+		if o.offset == 0 {
+			o.hash = md5.New()
+		}
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	if o.hash != nil {
+		o.hash.Write(p[:n])
+		if o.offset == o.info.Size && !bytes.Equal(o.hash.Sum(nil), o.info.MD5) {
+			o.offset -= int64(n)
+			return 0, errChecksumMismatch
+		}
+	}
+	return n, err
+}
+
+func (o *objectReader) Seek(offset int64, whence int) (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.info.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the object")
+	}
+	if offset != o.offset {
+		o.close()
+		o.offset = offset
+	}
+	return offset, nil
+}
+
+func (o *objectReader) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.close()
+}
+
+func (o *objectReader) close() error {
+	o.hash = nil
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+// validObjectName reports whether name is a file of the granules of the bucket
+func validObjectName(name string) bool {
+	if !strings.HasPrefix(name, "tiles/") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// downloadHandlerV1 streams a file of the bucket, e.g. a band image of a
+// granule, supporting range requests so that interrupted downloads can be
+// resumed. Complete downloads are verified against the md5 of the object,
+// and aborted if they do not match.
+func downloadHandlerV1(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+	name := mux.Vars(r)["object"]
+	if !validObjectName(name) {
+		writeError(w, http.StatusBadRequest, "bad object name %q", name)
+		return
+	}
+
+	info, err := objects.Stat(ctx, name)
+	if err == errObjectNotFound {
+		writeError(w, http.StatusNotFound, "%s: %v", name, err)
+		return
+	}
+	if err != nil {
+		logger.Errorf(ctx, "Failed to stat %s: %v", name, err)
+		writeError(w, http.StatusBadGateway, "%s: %v", name, err)
+		return
+	}
+
+	reader := &objectReader{ctx: ctx, store: objects, name: name, info: info}
+	defer reader.Close()
+
+	w.Header().Set("ETag", fmt.Sprintf("%q", info.ETag))
+	w.Header().Set("Digest", "md5="+base64.StdEncoding.EncodeToString(info.MD5))
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+	// the headers are sent before the object is read, so the client only
+	// learns of a failed read by the response ending short of its
+	// Content-Length, which makes the server close the connection
+	http.ServeContent(w, r, filepath.Base(name), info.Updated, &failingReadSeeker{ReadSeeker: reader, fail: func(err error) {
+		logger.Errorf(ctx, "Download of %s failed: %v", name, err)
+	}})
+}
+
+// failingReadSeeker calls fail on the first error but io.EOF of the reads
+// of its io.ReadSeeker, which http.ServeContent would silently ignore. The
+// reads may be made by a goroutine of http.ServeContent, in which fail
+// must not panic.
+type failingReadSeeker struct {
+	io.ReadSeeker
+	fail   func(error)
+	failed bool
+}
+
+func (c *failingReadSeeker) Read(p []byte) (int, error) {
+	n, err := c.ReadSeeker.Read(p)
+	if err != nil && err != io.EOF && !c.failed {
+		c.failed = true
+		c.fail(err)
+	}
+	return n, err
+}
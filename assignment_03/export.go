@@ -0,0 +1,362 @@
+package app
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// the archive formats of an export
+const (
+	formatZip = "zip"
+	formatTar = "tar"
+)
+
+// export is a request for the files of the scenes of a search as one archive,
+// optionally only of some bands and of scenes sensed within a time range
+type export struct {
+	Search search    `json:"search"`
+	Bands  []string  `json:"bands,omitempty"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Format string    `json:"format"`
+}
+
+// exportFile is a file of an export, as listed in its manifest
+type exportFile struct {
+	// Path is the path of the file in the archive
+	Path      string    `json:"path"`
+	Object    string    `json:"object"`
+	GranuleID string    `json:"granule_id"`
+	Size      int64     `json:"size"`
+	MD5       string    `json:"md5"`
+	Updated   time.Time `json:"updated"`
+}
+
+// objectInfo returns the metadata of the object of the file, as
+// recorded in the manifest
+func (f exportFile) objectInfo() objectInfo {
+	sum, _ := base64.StdEncoding.DecodeString(f.MD5)
+	return objectInfo{Size: f.Size, MD5: sum, Updated: f.Updated}
+}
+
+// exportManifest describes the contents of an export, and is written
+// to the archive as manifest.json before the files
+type exportManifest struct {
+	Export  export       `json:"export"`
+	Created time.Time    `json:"created"`
+	Scenes  []scene      `json:"scenes"`
+	Files   []exportFile `json:"files"`
+	// Size is the total size of the files
+	Size int64 `json:"size"`
+	// Missing are the image folders of scenes which failed to be listed,
+	// whose files are missing from the export
+	Missing []string `json:"missing,omitempty"`
+}
+
+// parseExport reads an export from the parameters of a request: those of
+// parseSearch, along with the bands as a comma separated list (e.g.
+// bands=B04,B08), the from and to dates as YYYY-MM-DD or RFC 3339, both
+// inclusive, and the format, zip (the default) or tar
+func parseExport(ctx context.Context, r *http.Request) (export, error) {
+	s, err := parseSearch(ctx, r)
+	if err != nil {
+		return export{}, err
+	}
+	e := export{Search: s, Format: r.FormValue("format")}
+	if e.Format == "" {
+		e.Format = formatZip
+	}
+	if e.Format != formatZip && e.Format != formatTar {
+		return export{}, fmt.Errorf("bad format %q, expected %s or %s", e.Format, formatZip, formatTar)
+	}
+	if bands := r.FormValue("bands"); bands != "" {
+		e.Bands = strings.Split(strings.ToUpper(bands), ",")
+	}
+	if e.From, err = parseTime(r, "from", false); err != nil {
+		return export{}, err
+	}
+	if e.To, err = parseTime(r, "to", true); err != nil {
+		return export{}, err
+	}
+	if !e.From.IsZero() && !e.To.IsZero() && e.To.Before(e.From) {
+		return export{}, fmt.Errorf("to %s is before from %s", e.To, e.From)
+	}
+	return e, nil
+}
+
+// parseTime parses the named form value as a date or an RFC 3339 time,
+// returning the end of the day of a date if end is set
+func parseTime(r *http.Request, name string, end bool) (time.Time, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		if end {
+			t = t.Add(24*time.Hour - time.Nanosecond)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad parameter %s: %q", name, value)
+	}
+	return t, nil
+}
+
+// hasBand reports whether the object is an image of one of the bands of
+// the export, named like T32UNG_20170701T103021_B04.jp2
+func (e export) hasBand(object string) bool {
+	if len(e.Bands) == 0 {
+		return true
+	}
+	base := path.Base(object)
+	base = strings.TrimSuffix(base, path.Ext(base))
+	for _, band := range e.Bands {
+		if strings.HasSuffix(base, "_"+band) {
+			return true
+		}
+	}
+	return false
+}
+
+// objectFromMediaLink returns the object name of a mediaLink of the
+// storage api, as returned by getImageUrls
+func objectFromMediaLink(mediaLink string) (string, error) {
+	u, err := url.Parse(mediaLink)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.SplitN(u.Path, "/o/", 2)
+	if len(parts) != 2 || !validObjectName(parts[1]) {
+		return "", fmt.Errorf("unexpected media link %q", mediaLink)
+	}
+	return parts[1], nil
+}
+
+// granuleOfObject returns the granule id in the name of an object, as in
+// tiles/32/U/NG/<product>.SAFE/GRANULE/<granule id>/IMG_DATA/<image>
+func granuleOfObject(object string) string {
+	parts := strings.Split(object, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if parts[i] == "GRANULE" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// resolve finds the files of the export, returning the status to respond
+// with if it fails
+func (e export) resolve(ctx context.Context) (*exportManifest, int, error) {
+	m, status, err := e.manifest(ctx)
+	if err != nil {
+		return nil, status, err
+	}
+	images, failed := getImagesWithProgress(ctx, sceneUrls(m.Scenes), nil)
+	if err := m.addMissing(failed); err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	status, err = m.addFiles(ctx, images)
+	return m, status, err
+}
+
+// addMissing records the image folders which failed to be listed in the
+// manifest, failing if none of the folders could be listed
+func (m *exportManifest) addMissing(failed []string) error {
+	if len(failed) > 0 && len(failed) == len(m.Scenes) {
+		return fmt.Errorf("failed to list the images of all %d scenes", len(m.Scenes))
+	}
+	m.Missing = failed
+	return nil
+}
+
+// manifest returns the manifest of the export listing its scenes,
+// but none of their files yet
+func (e export) manifest(ctx context.Context) (*exportManifest, int, error) {
+	found, status, err := e.Search.scenes(ctx, sceneFilter{From: e.From, To: e.To})
+	if err != nil {
+		return nil, status, err
+	}
+	return &exportManifest{Export: e, Created: time.Now().UTC(), Scenes: found, Files: make([]exportFile, 0)}, http.StatusOK, nil
+}
+
+// addFiles adds the images of the bands of the export among the listed
+// images to the manifest. Exports larger than the MaxExportSize of the
+// config are refused.
+func (m *exportManifest) addFiles(ctx context.Context, images []listedImage) (int, error) {
+	for _, image := range images {
+		object, err := objectFromMediaLink(image.MediaLink)
+		if err != nil {
+			return http.StatusBadGateway, err
+		}
+		if !m.Export.hasBand(object) {
+			continue
+		}
+		info, err := imageInfo(ctx, image, object)
+		if err != nil {
+			return http.StatusBadGateway, fmt.Errorf("%s: %v", object, err)
+		}
+		granule := granuleOfObject(object)
+		m.Files = append(m.Files, exportFile{
+			Path:      path.Join(granule, path.Base(object)),
+			Object:    object,
+			GranuleID: granule,
+			Size:      info.Size,
+			MD5:       base64.StdEncoding.EncodeToString(info.MD5),
+			Updated:   info.Updated,
+		})
+		m.Size += info.Size
+		if m.Size > config.MaxExportSize {
+			return http.StatusRequestEntityTooLarge,
+				fmt.Errorf("export exceeds the limit of %d bytes, narrow the search, bands or dates", config.MaxExportSize)
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// imageInfo returns the metadata of the object of the image as given by its
+// listing. Listings stored by a job before it was resumed only keep the url
+// of the image, whose object is looked up instead.
+func imageInfo(ctx context.Context, image listedImage, object string) (objectInfo, error) {
+	if image.MD5Hash == "" {
+		return objects.Stat(ctx, object)
+	}
+	sum, err := base64.StdEncoding.DecodeString(image.MD5Hash)
+	if err != nil {
+		return objectInfo{}, fmt.Errorf("bad md5Hash: %v", err)
+	}
+	return objectInfo{Size: image.Size, MD5: sum, Updated: image.Updated}, nil
+}
+
+// archiveWriter writes the entries of an archive one after another
+type archiveWriter interface {
+	Create(name string, size int64, modified time.Time) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (z zipArchive) Create(name string, size int64, modified time.Time) (io.Writer, error) {
+	// the images are compressed already
+	header := &zip.FileHeader{Name: name, Method: zip.Store}
+	header.SetModTime(modified)
+	return z.CreateHeader(header)
+}
+
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (t tarArchive) Create(name string, size int64, modified time.Time) (io.Writer, error) {
+	err := t.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modified, Typeflag: tar.TypeReg})
+	return t.Writer, err
+}
+
+// write writes the archive of the export to w, calling progress with the
+// bytes of files written so far after each file
+func (m *exportManifest) write(ctx context.Context, w io.Writer, progress func(written, total int64)) error {
+	archive := archiveWriter(zipArchive{zip.NewWriter(w)})
+	if m.Export.Format == formatTar {
+		archive = tarArchive{tar.NewWriter(w)}
+	}
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	entry, err := archive.Create("manifest.json", int64(len(manifest)), m.Created)
+	if err != nil {
+		return err
+	}
+	if _, err := entry.Write(manifest); err != nil {
+		return err
+	}
+
+	var written int64
+	for _, f := range m.Files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entry, err := archive.Create(f.Path, f.Size, f.Updated)
+		if err != nil {
+			return err
+		}
+		// reading the object from the start verifies its checksum
+		reader := &objectReader{ctx: ctx, store: objects, name: f.Object, info: f.objectInfo()}
+		n, err := io.Copy(entry, reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.Object, err)
+		}
+		if n != f.Size {
+			return fmt.Errorf("%s: read %d of %d bytes", f.Object, n, f.Size)
+		}
+		written += n
+		progress(written, m.Size)
+	}
+	return archive.Close()
+}
+
+// exportHandlerV1 streams the files of a search as a zip or tar archive,
+// see parseExport. The size of the export is announced in the X-Export-Size
+// header, letting clients report progress. With manifest=true only the
+// manifest is returned, to see what an export holds before downloading it.
+func exportHandlerV1(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+	resolveCtx, cancel := context.WithTimeout(ctx, config.Timeout)
+	defer cancel()
+
+	e, err := parseExport(resolveCtx, r)
+	if err != nil {
+		writeError(w, paramStatus(err), "%v", err)
+		return
+	}
+	m, status, err := e.resolve(resolveCtx)
+	if err != nil {
+		logger.Errorf(ctx, "Export of %s failed: %v", e.Search, err)
+		writeError(w, status, "%v", err)
+		return
+	}
+	if r.FormValue("manifest") == "true" {
+		writeJSON(w, http.StatusOK, m)
+		return
+	}
+
+	serveArchive(ctx, w, m)
+}
+
+// serveArchive streams the archive of the manifest as the response
+func serveArchive(ctx context.Context, w http.ResponseWriter, m *exportManifest) {
+	contentType := "application/zip"
+	if m.Export.Format == formatTar {
+		contentType = "application/x-tar"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"export.%s\"", m.Export.Format))
+	w.Header().Set("X-Export-Files", fmt.Sprint(len(m.Files)))
+	w.Header().Set("X-Export-Size", fmt.Sprint(m.Size))
+
+	err := m.write(ctx, w, func(written, total int64) {
+		logger.Debugf(ctx, "Exported %d of %d bytes of %s", written, total, m.Export.Search)
+	})
+	if err != nil {
+		logger.Errorf(ctx, "Export of %s failed: %v", m.Export.Search, err)
+		// abort rather than end the response, so the client does not
+		// take the truncated archive for a complete one
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// statCounter is an objectStore counting the objects it is asked about
+type statCounter struct {
+	stats int
+}
+
+func (s *statCounter) Stat(ctx context.Context, name string) (objectInfo, error) {
+	s.stats++
+	return objectInfo{Size: 7, MD5: []byte{1}}, nil
+}
+
+func (s *statCounter) Read(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	return nil, errors.New("not readable")
+}
+
+const testGranule = "tiles/32/U/NG/S2A_MSIL1C_20170701T103021.SAFE/GRANULE/L1C_T32UNG_A010609_20170701T103021/IMG_DATA/"
+
+// a page of the storage api listing the objects of a granule
+const testListing = `{
+  "kind": "storage#objects",
+  "items": [
+    {
+      "name": "` + testGranule + `T32UNG_20170701T103021_B04.jp2",
+      "mediaLink": "https://www.googleapis.com/download/storage/v1/b/gcp-public-data-sentinel-2/o/` +
+	"tiles%2F32%2FU%2FNG%2FS2A_MSIL1C_20170701T103021.SAFE%2FGRANULE%2FL1C_T32UNG_A010609_20170701T103021" +
+	`%2FIMG_DATA%2FT32UNG_20170701T103021_B04.jp2?generation=1499000000000000&alt=media",
+      "size": "109418254",
+      "md5Hash": "1B2M2Y8AsgTpgAmY7PhCfg==",
+      "updated": "2017-07-01T14:05:12.345Z"
+    },
+    {
+      "name": "` + testGranule + `T32UNG_20170701T103021_B08.jp2",
+      "mediaLink": "https://www.googleapis.com/download/storage/v1/b/gcp-public-data-sentinel-2/o/` +
+	"tiles%2F32%2FU%2FNG%2FS2A_MSIL1C_20170701T103021.SAFE%2FGRANULE%2FL1C_T32UNG_A010609_20170701T103021" +
+	`%2FIMG_DATA%2FT32UNG_20170701T103021_B08.jp2?generation=1499000000000000&alt=media",
+      "size": "112083120",
+      "md5Hash": "1B2M2Y8AsgTpgAmY7PhCfg==",
+      "updated": "2017-07-01T14:05:13.345Z"
+    }
+  ]
+}`
+
+func TestExportAddFilesFromListing(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testListing)
+	}))
+	defer server.Close()
+	saved := objects
+	store := &statCounter{}
+	objects = store
+	defer func() { objects = saved }()
+
+	images, failed := getImagesWithProgress(ctx, []string{server.URL}, nil)
+	if len(failed) != 0 || len(images) != 2 {
+		t.Fatalf("got %d images and failed %v, want 2 images", len(images), failed)
+	}
+	m := &exportManifest{Export: export{Bands: []string{"B04"}}}
+	if _, err := m.addFiles(ctx, images); err != nil {
+		t.Fatal(err)
+	}
+	if store.stats != 0 {
+		t.Errorf("got %d stats of objects, want none", store.stats)
+	}
+	if len(m.Files) != 1 {
+		t.Fatalf("got %d files, want the B04 image", len(m.Files))
+	}
+	f := m.Files[0]
+	updated := time.Date(2017, 7, 1, 14, 5, 12, 345000000, time.UTC)
+	if f.Size != 109418254 || f.MD5 != "1B2M2Y8AsgTpgAmY7PhCfg==" || !f.Updated.Equal(updated) || m.Size != f.Size {
+		t.Errorf("got file %+v of an export of %d bytes, want the metadata of the listing", f, m.Size)
+	}
+	if f.GranuleID != "L1C_T32UNG_A010609_20170701T103021" {
+		t.Errorf("got granule %q", f.GranuleID)
+	}
+
+	// the listings stored by a job keep only the urls
+	m = &exportManifest{Export: export{Bands: []string{"B04"}}}
+	if _, err := m.addFiles(ctx, []listedImage{{MediaLink: images[0].MediaLink}}); err != nil {
+		t.Fatal(err)
+	}
+	if store.stats != 1 || m.Files[0].Size != 7 {
+		t.Errorf("got %d stats and file %+v, want the object looked up", store.stats, m.Files[0])
+	}
+}
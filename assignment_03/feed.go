@@ -0,0 +1,104 @@
+package app
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+// tileFeedSize is the number of latest scenes in the feed of a tile
+const tileFeedSize = 50
+
+// atomFeed is an Atom feed, with the footprints of its entries as GeoRSS
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	GeoRSS  string      `xml:"xmlns:georss,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated time.Time   `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated time.Time  `xml:"updated"`
+	Summary string     `xml:"summary"`
+	Links   []atomLink `xml:"link"`
+	// Box is the bounding box of the footprint, as "south west north east"
+	Box string `xml:"georss:box"`
+}
+
+// tileFeed returns the feed of the latest scenes of the mgrs tile,
+// newest first
+func tileFeed(ctx context.Context, self, mgrs string) (atomFeed, error) {
+	scenes, err := getLatestScenesOfTile(ctx, mgrs, tileFeedSize)
+	if err != nil {
+		return atomFeed{}, err
+	}
+
+	feed := atomFeed{
+		GeoRSS:  "http://www.georss.org/georss",
+		ID:      self,
+		Title:   "Sentinel 2 scenes of tile " + mgrs,
+		Updated: time.Now().UTC(),
+		Author:  "Sentinel 2 image search",
+		Links:   []atomLink{{Rel: "self", Type: "application/atom+xml", Href: self}},
+		Entries: make([]atomEntry, 0, len(scenes)),
+	}
+	if len(scenes) > 0 {
+		feed.Updated = scenes[0].SensingTime.UTC()
+	}
+	for _, s := range scenes {
+		sensed := s.SensingTime.UTC().Format("2006-01-02 15:04 MST")
+		feed.Entries = append(feed.Entries, atomEntry{
+			// the image folder of a granule never moves, so it identifies the entry
+			ID:      s.URL,
+			Title:   fmt.Sprintf("%s sensed %s", s.GranuleID, sensed),
+			Updated: s.SensingTime.UTC(),
+			Summary: fmt.Sprintf("Tile %s sensed %s with %.1f%% cloud cover", s.MgrsTile, sensed, s.CloudCover),
+			Links:   []atomLink{{Rel: "alternate", Type: "application/json", Href: s.URL}},
+			Box:     fmt.Sprintf("%f %f %f %f", s.SouthLat, s.WestLng, s.NorthLat, s.EastLng),
+		})
+	}
+	return feed, nil
+}
+
+// tileFeedHandler serves the latest scenes of an mgrs tile as an Atom feed,
+// for feed readers to subscribe to
+func tileFeedHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(newContext(r), config.Timeout)
+	defer cancel()
+
+	mgrs := strings.ToUpper(mux.Vars(r)["mgrs"])
+	if !mgrsTilePattern.MatchString(mgrs) {
+		writeError(w, http.StatusBadRequest, "bad mgrs tile %q", mgrs)
+		return
+	}
+	feed, err := tileFeed(ctx, baseURL(r)+r.URL.Path, mgrs)
+	if err != nil {
+		searchFailed(ctx, w, err)
+		return
+	}
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
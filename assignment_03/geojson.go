@@ -0,0 +1,176 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang/geo/s2"
+)
+
+// geoJSON is any GeoJSON object, of which only the parts
+// describing polygons are read
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Geometries  []geoJSON       `json:"geometries"`
+	Features    []geoJSON       `json:"features"`
+}
+
+// geoJSONPolygon is a GeoJSON Polygon, as written in responses
+type geoJSONPolygon struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+// footprintFeature is a GeoJSON Feature of the footprint of a scene
+type footprintFeature struct {
+	Type       string              `json:"type"`
+	ID         string              `json:"id"`
+	Geometry   geoJSONPolygon      `json:"geometry"`
+	BBox       []float64           `json:"bbox"`
+	Properties footprintProperties `json:"properties"`
+}
+
+type footprintProperties struct {
+	GranuleID  string    `json:"granule_id"`
+	ProductID  string    `json:"product_id"`
+	MgrsTile   string    `json:"mgrs_tile"`
+	Date       time.Time `json:"date"`
+	CloudCover float64   `json:"cloud_cover"`
+	// URL is the storage api url of the image folder of the scene
+	URL string `json:"url"`
+	// Files are the image files of the scene, if they were listed
+	Files []string `json:"files,omitempty"`
+}
+
+// footprintCollection is a GeoJSON FeatureCollection of scene footprints
+type footprintCollection struct {
+	Type     string             `json:"type"`
+	Features []footprintFeature `json:"features"`
+}
+
+// footprintFeatureOf returns the footprint of the scene as a GeoJSON Feature
+func footprintFeatureOf(s scene) footprintFeature {
+	return footprintFeature{
+		Type:     "Feature",
+		ID:       s.GranuleID,
+		Geometry: s.FootprintGeoJSON(),
+		BBox:     s.BBox(),
+		Properties: footprintProperties{
+			GranuleID:  s.GranuleID,
+			ProductID:  s.ProductID,
+			MgrsTile:   s.MgrsTile,
+			Date:       s.SensingTime.UTC(),
+			CloudCover: s.CloudCover,
+			URL:        s.URL,
+		},
+	}
+}
+
+// footprintCollectionOf returns the footprints of the scenes as a GeoJSON
+// FeatureCollection, along with their image files found in files by the
+// url of their image folder
+func footprintCollectionOf(scenes []scene, files map[string][]string) footprintCollection {
+	features := make([]footprintFeature, 0, len(scenes))
+	for _, s := range scenes {
+		f := footprintFeatureOf(s)
+		f.Properties.Files = files[s.URL]
+		features = append(features, f)
+	}
+	return footprintCollection{Type: "FeatureCollection", Features: features}
+}
+
+// ParseGeoJSON parses a GeoJSON Polygon or MultiPolygon, or a Feature,
+// FeatureCollection or GeometryCollection of them, returning the vertices of
+// all their rings like ParsePolyFile. The rings are expected to follow the
+// right hand rule of RFC 7946, so a ring wound clockwise is taken to enclose
+// the rest of the world.
+func ParseGeoJSON(reader io.Reader) ([][]s2.Point, error) {
+	var object geoJSON
+	if err := json.NewDecoder(reader).Decode(&object); err != nil {
+		return nil, fmt.Errorf("geojson: %v", err)
+	}
+
+	rings, err := object.rings()
+	if err != nil {
+		return nil, fmt.Errorf("geojson: %v", err)
+	}
+	return orientRings(rings)
+}
+
+// rings returns the vertices of the rings of the polygons in the object
+func (g *geoJSON) rings() ([]windingRing, error) {
+	switch g.Type {
+	case "Polygon":
+		var polygon [][][]float64
+		if err := json.Unmarshal(g.Coordinates, &polygon); err != nil {
+			return nil, fmt.Errorf("bad Polygon coordinates: %v", err)
+		}
+		return geoJSONRings(polygon)
+	case "MultiPolygon":
+		var polygons [][][][]float64
+		if err := json.Unmarshal(g.Coordinates, &polygons); err != nil {
+			return nil, fmt.Errorf("bad MultiPolygon coordinates: %v", err)
+		}
+		rings := make([]windingRing, 0)
+		for _, polygon := range polygons {
+			r, err := geoJSONRings(polygon)
+			if err != nil {
+				return nil, err
+			}
+			rings = append(rings, r...)
+		}
+		return rings, nil
+	case "Feature":
+		if g.Geometry == nil {
+			return nil, fmt.Errorf("feature without a geometry")
+		}
+		return g.Geometry.rings()
+	case "FeatureCollection":
+		return geoJSONCollectionRings(g.Features)
+	case "GeometryCollection":
+		return geoJSONCollectionRings(g.Geometries)
+	default:
+		return nil, fmt.Errorf("unsupported type %q, expected a polygon", g.Type)
+	}
+}
+
+func geoJSONCollectionRings(objects []geoJSON) ([]windingRing, error) {
+	rings := make([]windingRing, 0)
+	for i := range objects {
+		r, err := objects[i].rings()
+		if err != nil {
+			return nil, err
+		}
+		rings = append(rings, r...)
+	}
+	if len(rings) == 0 {
+		return nil, fmt.Errorf("collection without polygons")
+	}
+	return rings, nil
+}
+
+// geoJSONRings converts the positions of the rings of a GeoJSON polygon,
+// given as longitude latitude with an optional altitude. The first ring is
+// the outer ring, and any others are holes.
+func geoJSONRings(polygon [][][]float64) ([]windingRing, error) {
+	rings := make([]windingRing, 0, len(polygon))
+	for i, positions := range polygon {
+		ring := make([]s2.Point, 0, len(positions))
+		for _, position := range positions {
+			if len(position) < 2 {
+				return nil, fmt.Errorf("position %v has less than two coordinates", position)
+			}
+			point, err := pointFromLngLat(position[0], position[1])
+			if err != nil {
+				return nil, err
+			}
+			ring = append(ring, point)
+		}
+		rings = append(rings, windingRing{points: ring, hole: i > 0})
+	}
+	return rings, nil
+}
@@ -0,0 +1,261 @@
+package app
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/geo/s2"
+	"golang.org/x/net/context"
+)
+
+// indexCoverer covers the footprints of the scenes in a sceneIndex, and the
+// regions looked up in it, with cells of levels 6, 8 and 10, which are
+// roughly 150, 40 and 10 kilometres across
+var indexCoverer = CoverOptions{MinLevel: 6, MaxLevel: 10, LevelMod: 2, MaxCells: 8}
+
+// the levels of indexCoverer, from the largest cells to the smallest
+var indexLevels = []int{6, 8, 10}
+
+// sceneIndex is a catalog of scenes, indexed by the cells covering their
+// footprints, such that the scenes of a region are found by looking up
+// the cells of its covering rather than scanning the whole index
+type sceneIndex struct {
+	// scenes are sorted by mgrs tile
+	scenes []scene
+	// entries are sorted by cell
+	entries []indexEntry
+}
+
+// indexEntry records that a cell covers part of the footprint of a scene
+type indexEntry struct {
+	cell  s2.CellID
+	scene int32
+}
+
+// sceneCatalog holds the *sceneIndex searched by the index backend, loaded
+// by Configure, or once built if there was none to load. Searches query
+// BigQuery while there is none.
+var sceneCatalog atomic.Value
+
+// catalog returns the sceneIndex searched by the index backend, or nil
+func catalog() *sceneIndex {
+	idx, _ := sceneCatalog.Load().(*sceneIndex)
+	return idx
+}
+
+func setCatalog(idx *sceneIndex) {
+	sceneCatalog.Store(idx)
+}
+
+// newSceneIndex indexes the given scenes
+func newSceneIndex(scenes []scene) *sceneIndex {
+	sort.Slice(scenes, func(i, j int) bool { return scenes[i].MgrsTile < scenes[j].MgrsTile })
+	idx := &sceneIndex{scenes: scenes}
+	for i, s := range scenes {
+		for _, cell := range indexCoverer.Cover(s.Rect()) {
+			idx.entries = append(idx.entries, indexEntry{cell, int32(i)})
+		}
+	}
+	idx.sortEntries()
+	return idx
+}
+
+func (idx *sceneIndex) sortEntries() {
+	sort.Slice(idx.entries, func(i, j int) bool { return idx.entries[i].cell < idx.entries[j].cell })
+}
+
+// lookup adds the scenes of the entries with cells between min and max
+// to the set of scenes
+func (idx *sceneIndex) lookup(min, max s2.CellID, found map[int32]bool) {
+	i := sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].cell >= min })
+	for ; i < len(idx.entries) && idx.entries[i].cell <= max; i++ {
+		found[idx.entries[i].scene] = true
+	}
+}
+
+// candidates returns the scenes which may intersect the region: those
+// indexed by a cell of its covering, by a descendant or by an ancestor of one
+func (idx *sceneIndex) candidates(region s2.Region) []scene {
+	found := make(map[int32]bool)
+	query := indexCoverer
+	query.MaxCells = 32
+	for _, cell := range query.Cover(region) {
+		idx.lookup(cell.RangeMin(), cell.RangeMax(), found)
+		for _, level := range indexLevels {
+			if level < cell.Level() {
+				parent := cell.Parent(level)
+				idx.lookup(parent, parent, found)
+			}
+		}
+	}
+
+	scenes := make([]scene, 0, len(found))
+	for i := range found {
+		scenes = append(scenes, idx.scenes[i])
+	}
+	return scenes
+}
+
+// intersecting returns the scenes whose footprint intersects the polygon
+func (idx *sceneIndex) intersecting(polygon *s2.Polygon) []scene {
+	scenes := make([]scene, 0)
+	for _, s := range idx.candidates(polygon) {
+		if polygon.Intersects(s.Footprint()) {
+			scenes = append(scenes, s)
+		}
+	}
+	return scenes
+}
+
+// intersectingRect returns the scenes whose footprint intersects the rectangle
+func (idx *sceneIndex) intersectingRect(rect s2.Rect) []scene {
+	scenes := make([]scene, 0)
+	for _, s := range idx.candidates(rect) {
+		if rect.Intersects(s.Rect()) {
+			scenes = append(scenes, s)
+		}
+	}
+	return scenes
+}
+
+// within returns the scenes whose footprint is within the rectangle
+func (idx *sceneIndex) within(rect s2.Rect) []scene {
+	scenes := make([]scene, 0)
+	for _, s := range idx.candidates(rect) {
+		if rect.Contains(s.Rect()) {
+			scenes = append(scenes, s)
+		}
+	}
+	return scenes
+}
+
+// withTilePrefix returns the scenes whose mgrs tile starts with the prefix
+func (idx *sceneIndex) withTilePrefix(prefix string) []scene {
+	i := sort.Search(len(idx.scenes), func(i int) bool { return idx.scenes[i].MgrsTile >= prefix })
+	scenes := make([]scene, 0)
+	for ; i < len(idx.scenes) && strings.HasPrefix(idx.scenes[i].MgrsTile, prefix); i++ {
+		scenes = append(scenes, idx.scenes[i])
+	}
+	return scenes
+}
+
+// withGranule returns the scenes of the granule, looked up one by one as
+// the index is not sorted by granule
+func (idx *sceneIndex) withGranule(granuleID string) []scene {
+	scenes := make([]scene, 0, 1)
+	for _, s := range idx.scenes {
+		if s.GranuleID == granuleID {
+			scenes = append(scenes, s)
+		}
+	}
+	return scenes
+}
+
+// indexFile is the on disk representation of a sceneIndex
+type indexFile struct {
+	Scenes []scene
+	Cells  []uint64
+	Refs   []int32
+}
+
+// save writes the index to the file at path
+func (idx *sceneIndex) save(path string) error {
+	file := indexFile{Scenes: idx.scenes}
+	for _, e := range idx.entries {
+		file.Cells = append(file.Cells, uint64(e.cell))
+		file.Refs = append(file.Refs, e.scene)
+	}
+
+	// written next to path and renamed, so that a save cut short does not
+	// leave a corrupt index to be loaded on the next start
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(&file); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readSceneIndex reads an index written by save
+func readSceneIndex(path string) (*sceneIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file indexFile
+	if err := gob.NewDecoder(f).Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(file.Cells) != len(file.Refs) {
+		return nil, fmt.Errorf("%s: corrupt index", path)
+	}
+	idx := &sceneIndex{scenes: file.Scenes, entries: make([]indexEntry, len(file.Cells))}
+	for i := range file.Cells {
+		if file.Refs[i] < 0 || int(file.Refs[i]) >= len(file.Scenes) {
+			return nil, fmt.Errorf("%s: corrupt index", path)
+		}
+		idx.entries[i] = indexEntry{s2.CellID(file.Cells[i]), file.Refs[i]}
+	}
+	return idx, nil
+}
+
+// buildSceneIndex indexes every scene of the BigQuery index
+func buildSceneIndex(ctx context.Context) (*sceneIndex, error) {
+	scenes, err := queryScenes(ctx, `
+			SELECT `+sceneColumns+`
+			FROM `+"`bigquery-public-data.cloud_storage_geo_index.sentinel_2_index`")
+	if err != nil {
+		return nil, err
+	}
+	return newSceneIndex(scenes), nil
+}
+
+// loadSceneIndex makes the index at path the catalog. If there is none yet,
+// it is built from BigQuery in the background within timeout, saved at path
+// and made the catalog once done.
+func loadSceneIndex(path string, timeout time.Duration) error {
+	idx, err := readSceneIndex(path)
+	if err == nil {
+		setCatalog(idx)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	err = runDetached(func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		logger.Infof(ctx, "No scene index at %s, building it from BigQuery", path)
+		idx, err := buildSceneIndex(ctx)
+		if err != nil {
+			logger.Errorf(ctx, "Failed to build the scene index: %v", err)
+			return
+		}
+		// the index is used even if it cannot be saved, to be built again
+		// on the next start
+		if err := idx.save(path); err != nil {
+			logger.Errorf(ctx, "Failed to save the scene index: %v", err)
+		}
+		setCatalog(idx)
+		logger.Infof(ctx, "Built the scene index of %d scenes", len(idx.scenes))
+	})
+	if err != nil {
+		return fmt.Errorf("no index at %s, and it cannot be built: %v", path, err)
+	}
+	return nil
+}
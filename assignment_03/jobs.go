@@ -0,0 +1,436 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+// the kinds of job
+const (
+	// jobImages lists the images of the scenes of a search
+	jobImages = "images"
+	// jobExport resolves the files of an export, whose archive is then
+	// downloaded from /v1/jobs/{id}/archive
+	jobExport = "export"
+)
+
+// the states of a job
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// Job is a search or export run in the background, outliving the request
+// starting it
+type Job struct {
+	ID       string      `json:"id"`
+	Kind     string      `json:"kind"`
+	Search   search      `json:"search"`
+	Export   *export     `json:"export,omitempty"`
+	State    string      `json:"state"`
+	Progress JobProgress `json:"progress"`
+	Error    string      `json:"error,omitempty"`
+	Created  time.Time   `json:"created"`
+	Updated  time.Time   `json:"updated"`
+	Result   *JobResult  `json:"result,omitempty"`
+	// Callback is the url the job is posted to once finished, and
+	// CallbackState whether it was delivered there
+	Callback      string `json:"callback,omitempty"`
+	CallbackState string `json:"callback_state,omitempty"`
+}
+
+// JobProgress counts the directories of the scenes of a job listed so far
+type JobProgress struct {
+	Directories int `json:"directories"`
+	Listed      int `json:"listed"`
+	Images      int `json:"images"`
+}
+
+// JobResult is the result of a job, the images of an images job or the
+// manifest of an export job
+type JobResult struct {
+	Count    int             `json:"count"`
+	Images   []string        `json:"images,omitempty"`
+	Manifest *exportManifest `json:"manifest,omitempty"`
+	// Failed are the directories which failed to be listed, whose images
+	// are missing from the result
+	Failed []string `json:"failed,omitempty"`
+}
+
+// finished reports whether the job has stopped running
+func (job *Job) finished() bool {
+	return job.State != jobRunning
+}
+
+// jobRunner runs jobs in the background, keeping them in its store
+type jobRunner struct {
+	store JobStore
+
+	mu sync.Mutex
+	// cancels are closed to cancel the running job of the id
+	cancels map[string]chan struct{}
+}
+
+func newJobRunner(store JobStore) *jobRunner {
+	return &jobRunner{store: store, cancels: make(map[string]chan struct{})}
+}
+
+// jobs is the jobRunner of the app
+var jobs = newJobRunner(newMemoryJobStore())
+
+// newID returns a random id for a job or subscription
+func newID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// start stores the job and runs it in the background
+func (j *jobRunner) start(ctx context.Context, job *Job) error {
+	j.expire(ctx)
+
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	job.ID = id
+	job.State = jobRunning
+	job.Created = time.Now().UTC()
+	job.Updated = job.Created
+	if err := j.store.Put(ctx, job); err != nil {
+		return err
+	}
+	// the job runs on a copy, leaving job to the caller
+	running := *job
+	return j.launch(ctx, &running)
+}
+
+// resume restarts the jobs of the store left running by a previous
+// process, and retries the callbacks it left undelivered
+func (j *jobRunner) resume(ctx context.Context) error {
+	all, err := j.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, job := range all {
+		if job.finished() {
+			if job.CallbackState == callbackPending {
+				job := job
+				if err := runInBackground(ctx, func(ctx context.Context) { j.notify(ctx, job) }); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		logger.Infof(ctx, "Resuming %s job %s", job.Kind, job.ID)
+		if err := j.launch(ctx, job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// launch runs the stored job in the background
+func (j *jobRunner) launch(ctx context.Context, job *Job) error {
+	cancel := make(chan struct{})
+	j.mu.Lock()
+	j.cancels[job.ID] = cancel
+	j.mu.Unlock()
+
+	err := runInBackground(ctx, func(ctx context.Context) {
+		runCtx, stop := context.WithCancel(ctx)
+		defer stop()
+		go func() {
+			select {
+			case <-cancel:
+				stop()
+			case <-runCtx.Done():
+			}
+		}()
+		j.run(ctx, runCtx, job)
+	})
+	if err != nil {
+		j.finish(ctx, job, err)
+	}
+	return err
+}
+
+// cancel cancels the job of the id, reporting whether it was running
+func (j *jobRunner) cancel(id string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	cancel, ok := j.cancels[id]
+	if ok {
+		close(cancel)
+		delete(j.cancels, id)
+	}
+	return ok
+}
+
+// run runs the job, with runCtx being cancelled if the job is.
+// The job is stored with ctx, so its final state is stored even then.
+func (j *jobRunner) run(ctx, runCtx context.Context, job *Job) {
+	logger.Infof(ctx, "Starting %s job %s of %s", job.Kind, job.ID, job.Search)
+	var err error
+	switch job.Kind {
+	case jobImages:
+		err = j.runImages(ctx, runCtx, job)
+	case jobExport:
+		err = j.runExport(ctx, runCtx, job)
+	default:
+		err = fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+	if runCtx.Err() == context.Canceled {
+		err = context.Canceled
+	}
+	j.finish(ctx, job, err)
+	if job.Callback != "" {
+		j.notify(ctx, job)
+	}
+}
+
+func (j *jobRunner) runImages(ctx, runCtx context.Context, job *Job) error {
+	scenes, _, err := job.Search.scenes(runCtx, sceneFilter{})
+	if err != nil {
+		return err
+	}
+	directories := sceneUrls(scenes)
+	images, failed, err := j.listImages(ctx, runCtx, job, directories)
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 && len(failed) == len(directories) {
+		return fmt.Errorf("failed to list the images of all %d scenes", len(directories))
+	}
+	job.Result = &JobResult{Count: len(images), Images: mediaLinks(images), Failed: failed}
+	return nil
+}
+
+func (j *jobRunner) runExport(ctx, runCtx context.Context, job *Job) error {
+	m, _, err := job.Export.manifest(runCtx)
+	if err != nil {
+		return err
+	}
+	images, failed, err := j.listImages(ctx, runCtx, job, sceneUrls(m.Scenes))
+	if err != nil {
+		return err
+	}
+	if err := m.addMissing(failed); err != nil {
+		return err
+	}
+	if _, err := m.addFiles(runCtx, images); err != nil {
+		return err
+	}
+	job.Result = &JobResult{Count: len(m.Files), Manifest: m, Failed: failed}
+	return nil
+}
+
+// listImages lists the images of the directories like getImagesWithProgress,
+// recording the progress of the job and the listed directories. Directories
+// listed before the job was resumed are not listed again, and their images
+// are returned without the metadata of their objects. The directories
+// failing to be listed are returned as failed.
+func (j *jobRunner) listImages(ctx, runCtx context.Context, job *Job, directories []string) ([]listedImage, []string, error) {
+	listed, err := j.store.Listings(ctx, job.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	images := make([]listedImage, 0)
+	remaining := make([]string, 0, len(directories))
+	for _, directory := range directories {
+		if urls, ok := listed[directory]; ok {
+			for _, url := range urls {
+				images = append(images, listedImage{MediaLink: url})
+			}
+		} else {
+			remaining = append(remaining, directory)
+		}
+	}
+
+	job.Progress = JobProgress{
+		Directories: len(directories),
+		Listed:      len(directories) - len(remaining),
+		Images:      len(images),
+	}
+	j.update(ctx, job)
+	found, failed := getImagesWithProgress(runCtx, remaining, func(directory string, found []listedImage) {
+		job.Progress.Listed++
+		job.Progress.Images += len(found)
+		job.Updated = time.Now().UTC()
+		if err := j.store.AddListing(ctx, job, directory, mediaLinks(found)); err != nil {
+			logger.Errorf(ctx, "Failed to store listing of job %s: %v", job.ID, err)
+		}
+	})
+	return append(images, found...), failed, nil
+}
+
+// finish records the end of the job, failed if err is not nil
+func (j *jobRunner) finish(ctx context.Context, job *Job, err error) {
+	j.mu.Lock()
+	delete(j.cancels, job.ID)
+	j.mu.Unlock()
+
+	switch {
+	case err == context.Canceled:
+		job.State = jobCancelled
+		job.Result = nil
+	case err != nil:
+		job.State = jobFailed
+		job.Error = err.Error()
+		job.Result = nil
+	default:
+		job.State = jobDone
+	}
+	if job.Callback != "" {
+		job.CallbackState = callbackPending
+	}
+	logger.Infof(ctx, "Job %s %s", job.ID, job.State)
+	j.update(ctx, job)
+}
+
+// update stores the current state of the job
+func (j *jobRunner) update(ctx context.Context, job *Job) {
+	job.Updated = time.Now().UTC()
+	if err := j.store.Put(ctx, job); err != nil {
+		logger.Errorf(ctx, "Failed to store job %s: %v", job.ID, err)
+	}
+}
+
+// expire deletes the jobs which finished longer than the JobRetention
+// of the config ago
+func (j *jobRunner) expire(ctx context.Context) {
+	all, err := j.store.List(ctx)
+	if err != nil {
+		logger.Errorf(ctx, "Failed to list jobs: %v", err)
+		return
+	}
+	for _, job := range all {
+		if job.finished() && time.Since(job.Updated) > config.JobRetention {
+			if err := j.store.Delete(ctx, job.ID); err != nil {
+				logger.Errorf(ctx, "Failed to delete job %s: %v", job.ID, err)
+			}
+		}
+	}
+}
+
+// getJob returns the job of the request, writing the error response if
+// there is none
+func getJob(ctx context.Context, w http.ResponseWriter, r *http.Request) (*Job, bool) {
+	id := mux.Vars(r)["id"]
+	job, err := jobs.store.Get(ctx, id)
+	if err == errJobNotFound {
+		writeError(w, http.StatusNotFound, "%s: %v", id, err)
+		return nil, false
+	}
+	if err != nil {
+		logger.Errorf(ctx, "Failed to load job %s: %v", id, err)
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return nil, false
+	}
+	return job, true
+}
+
+// createJobHandlerV1 starts a job of the kind parameter, images (the
+// default) taking the parameters of parseSearch or export taking those
+// of parseExport, and responds with the job and its url. With a callback
+// parameter, the job is posted to the callback url once finished.
+func createJobHandlerV1(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+	parseCtx, cancel := context.WithTimeout(ctx, config.Timeout)
+	defer cancel()
+
+	job := &Job{Kind: r.FormValue("kind"), Callback: r.FormValue("callback")}
+	if err := validateCallback(parseCtx, job.Callback); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	var err error
+	switch job.Kind {
+	case "", jobImages:
+		job.Kind = jobImages
+		job.Search, err = parseSearch(parseCtx, r)
+	case jobExport:
+		var e export
+		e, err = parseExport(parseCtx, r)
+		job.Search, job.Export = e.Search, &e
+	default:
+		err = fmt.Errorf("bad kind %q, expected %s or %s", job.Kind, jobImages, jobExport)
+	}
+	if err != nil {
+		writeError(w, paramStatus(err), "%v", err)
+		return
+	}
+
+	if err := jobs.start(ctx, job); err != nil {
+		logger.Errorf(ctx, "Failed to start job: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to start job: %v", err)
+		return
+	}
+	w.Header().Set("Location", "/v1/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// jobHandlerV1 returns the state, progress and result of a job
+func jobHandlerV1(w http.ResponseWriter, r *http.Request) {
+	if job, ok := getJob(newContext(r), w, r); ok {
+		writeJSON(w, http.StatusOK, job)
+	}
+}
+
+// deleteJobHandlerV1 cancels a running job, or deletes a finished one.
+// A job still being stopped or notifying its callback is stored again once
+// done, so it cannot be deleted until then.
+func deleteJobHandlerV1(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+	job, ok := getJob(ctx, w, r)
+	if !ok {
+		return
+	}
+	switch {
+	case !job.finished() && jobs.cancel(job.ID):
+		writeJSON(w, http.StatusAccepted, job)
+		return
+	case !job.finished():
+		writeError(w, http.StatusConflict, "job %s is still stopping", job.ID)
+		return
+	case job.CallbackState == callbackPending:
+		writeError(w, http.StatusConflict, "job %s is still notifying its callback", job.ID)
+		return
+	}
+	if err := jobs.store.Delete(ctx, job.ID); err != nil {
+		logger.Errorf(ctx, "Failed to delete job %s: %v", job.ID, err)
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// jobArchiveHandlerV1 streams the archive of a finished export job
+func jobArchiveHandlerV1(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+	job, ok := getJob(ctx, w, r)
+	if !ok {
+		return
+	}
+	if job.Kind != jobExport {
+		writeError(w, http.StatusNotFound, "job %s is not an export", job.ID)
+		return
+	}
+	if job.State != jobDone {
+		writeError(w, http.StatusConflict, "job %s is %s", job.ID, job.State)
+		return
+	}
+	serveArchive(ctx, w, job.Result.Manifest)
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+func TestDeleteJob(t *testing.T) {
+	ctx := context.Background()
+	saved := jobs
+	jobs = newJobRunner(newMemoryJobStore())
+	defer func() { jobs = saved }()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/jobs/{id}", deleteJobHandlerV1).Methods(http.MethodDelete)
+	deleteJob := func(id string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/v1/jobs/"+id, nil))
+		return w.Code
+	}
+
+	// a running job, as launched but without running anything
+	job := &Job{ID: "job", Kind: jobImages, State: jobRunning}
+	if err := jobs.store.Put(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	jobs.cancels[job.ID] = make(chan struct{})
+
+	if status := deleteJob(job.ID); status != http.StatusAccepted {
+		t.Fatalf("cancelling: got status %d, want %d", status, http.StatusAccepted)
+	}
+	// the job is still stopping, and would be stored again once stopped
+	if status := deleteJob(job.ID); status != http.StatusConflict {
+		t.Fatalf("deleting while stopping: got status %d, want %d", status, http.StatusConflict)
+	}
+	jobs.finish(ctx, job, context.Canceled)
+	if _, err := jobs.store.Get(ctx, job.ID); err != nil {
+		t.Fatalf("got error %v for the stopped job", err)
+	}
+
+	if status := deleteJob(job.ID); status != http.StatusNoContent {
+		t.Fatalf("deleting: got status %d, want %d", status, http.StatusNoContent)
+	}
+	if _, err := jobs.store.Get(ctx, job.ID); err != errJobNotFound {
+		t.Fatalf("got error %v for the deleted job, want %v", err, errJobNotFound)
+	}
+	if status := deleteJob(job.ID); status != http.StatusNotFound {
+		t.Fatalf("deleting again: got status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestDeleteJobPendingCallback(t *testing.T) {
+	ctx := context.Background()
+	saved := jobs
+	jobs = newJobRunner(newMemoryJobStore())
+	defer func() { jobs = saved }()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/jobs/{id}", deleteJobHandlerV1).Methods(http.MethodDelete)
+
+	job := &Job{ID: "job", Kind: jobImages, State: jobDone, Callback: "https://example.com/hook", CallbackState: callbackPending}
+	if err := jobs.store.Put(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/v1/jobs/"+job.ID, nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusConflict)
+	}
+}
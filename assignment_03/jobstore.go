@@ -0,0 +1,105 @@
+package app
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// JobStore keeps jobs along with their progress and results. While a job
+// runs, the store also keeps the directories it has listed, so that the job
+// resumes where it stopped if the process is restarted.
+type JobStore interface {
+	// Put stores the job, replacing the job of the same id.
+	// Storing a finished job drops its listings.
+	Put(ctx context.Context, job *Job) error
+	// Get returns the job of the id, or errJobNotFound
+	Get(ctx context.Context, id string) (*Job, error)
+	// List returns all jobs, oldest first
+	List(ctx context.Context) ([]*Job, error)
+	// Delete removes the job of the id and its listings, if stored
+	Delete(ctx context.Context, id string) error
+	// AddListing records the urls of a directory listed by the running job,
+	// storing the job along with them like Put, so that its progress is
+	// stored at once with what it counts
+	AddListing(ctx context.Context, job *Job, directory string, urls []string) error
+	// Listings returns the urls of the directories listed by the job of
+	// the id so far, by directory
+	Listings(ctx context.Context, id string) (map[string][]string, error)
+}
+
+var errJobNotFound = errors.New("job not found")
+
+// memoryJobStore keeps jobs in memory, losing them when the process exits
+type memoryJobStore struct {
+	mu       sync.Mutex
+	jobs     map[string]Job
+	listings map[string]map[string][]string
+}
+
+func newMemoryJobStore() *memoryJobStore {
+	return &memoryJobStore{jobs: make(map[string]Job), listings: make(map[string]map[string][]string)}
+}
+
+func (m *memoryJobStore) Put(ctx context.Context, job *Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[job.ID] = *job
+	if job.finished() {
+		delete(m.listings, job.ID)
+	}
+	return nil
+}
+
+func (m *memoryJobStore) Get(ctx context.Context, id string) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, errJobNotFound
+	}
+	return &job, nil
+}
+
+func (m *memoryJobStore) List(ctx context.Context) ([]*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		job := job
+		jobs = append(jobs, &job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+	return jobs, nil
+}
+
+func (m *memoryJobStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.jobs, id)
+	delete(m.listings, id)
+	return nil
+}
+
+func (m *memoryJobStore) AddListing(ctx context.Context, job *Job, directory string, urls []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[job.ID] = *job
+	if m.listings[job.ID] == nil {
+		m.listings[job.ID] = make(map[string][]string)
+	}
+	m.listings[job.ID][directory] = urls
+	return nil
+}
+
+func (m *memoryJobStore) Listings(ctx context.Context, id string) (map[string][]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	listings := make(map[string][]string, len(m.listings[id]))
+	for directory, urls := range m.listings[id] {
+		listings[directory] = urls
+	}
+	return listings, nil
+}
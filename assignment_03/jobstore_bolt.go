@@ -0,0 +1,149 @@
+// +build !appengine
+
+package app
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/net/context"
+)
+
+var (
+	jobsBucket     = []byte("jobs")
+	listingsBucket = []byte("listings")
+)
+
+// boltJobStore keeps jobs in a bolt database on disk, so they survive
+// restarts. Jobs are kept as json by id in the jobs bucket, and the listings
+// of a running job in a bucket of its id in the listings bucket.
+type boltJobStore struct {
+	db *bolt.DB
+}
+
+// openJobStore opens the job store in the file at path, creating it if missing
+func openJobStore(path string) (JobStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{jobsBucket, listingsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltJobStore{db}, nil
+}
+
+func deleteListings(tx *bolt.Tx, id string) error {
+	err := tx.Bucket(listingsBucket).DeleteBucket([]byte(id))
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
+
+func (b *boltJobStore) Put(ctx context.Context, job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(jobsBucket).Put([]byte(job.ID), data); err != nil {
+			return err
+		}
+		if job.finished() {
+			return deleteListings(tx, job.ID)
+		}
+		return nil
+	})
+}
+
+func (b *boltJobStore) Get(ctx context.Context, id string) (*Job, error) {
+	var job *Job
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(jobsBucket).Get([]byte(id))
+		if data == nil {
+			return errJobNotFound
+		}
+		job = &Job{}
+		return json.Unmarshal(data, job)
+	})
+	return job, err
+}
+
+func (b *boltJobStore) List(ctx context.Context) ([]*Job, error) {
+	jobs := make([]*Job, 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(id, data []byte) error {
+			job := &Job{}
+			if err := json.Unmarshal(data, job); err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+	return jobs, err
+}
+
+func (b *boltJobStore) Delete(ctx context.Context, id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(jobsBucket).Delete([]byte(id)); err != nil {
+			return err
+		}
+		return deleteListings(tx, id)
+	})
+}
+
+// AddListing writes the listing and the job in a single transaction, as
+// every transaction costs a sync of the file
+func (b *boltJobStore) AddListing(ctx context.Context, job *Job, directory string, urls []string) error {
+	data, err := json.Marshal(urls)
+	if err != nil {
+		return err
+	}
+	jobData, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		listings, err := tx.Bucket(listingsBucket).CreateBucketIfNotExists([]byte(job.ID))
+		if err != nil {
+			return err
+		}
+		if err := listings.Put([]byte(directory), data); err != nil {
+			return err
+		}
+		return tx.Bucket(jobsBucket).Put([]byte(job.ID), jobData)
+	})
+}
+
+func (b *boltJobStore) Listings(ctx context.Context, id string) (map[string][]string, error) {
+	listings := make(map[string][]string)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(listingsBucket).Bucket([]byte(id))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(directory, data []byte) error {
+			var urls []string
+			if err := json.Unmarshal(data, &urls); err != nil {
+				return err
+			}
+			listings[string(directory)] = urls
+			return nil
+		})
+	})
+	return listings, err
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/golang/geo/s2"
+)
+
+// kmlPolygon is a Polygon element of a KML document
+type kmlPolygon struct {
+	Outer string   `xml:"outerBoundaryIs>LinearRing>coordinates"`
+	Inner []string `xml:"innerBoundaryIs>LinearRing>coordinates"`
+}
+
+// ParseKML parses the polygons of the placemarks in a KML document,
+// including those within a MultiGeometry, returning the vertices of all
+// their rings like ParsePolyFile. As KML asks, outer boundaries are expected
+// counter clockwise, and inner boundaries clockwise.
+func ParseKML(reader io.Reader) ([][]s2.Point, error) {
+	decoder := xml.NewDecoder(reader)
+	rings := make([]windingRing, 0)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("kml: %v", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "Polygon" {
+			continue
+		}
+
+		var polygon kmlPolygon
+		if err := decoder.DecodeElement(&polygon, &start); err != nil {
+			return nil, fmt.Errorf("kml: %v", err)
+		}
+		for i, coordinates := range append([]string{polygon.Outer}, polygon.Inner...) {
+			ring, err := kmlRing(coordinates)
+			if err != nil {
+				return nil, fmt.Errorf("kml: %v", err)
+			}
+			rings = append(rings, windingRing{points: ring, hole: i > 0})
+		}
+	}
+	if len(rings) == 0 {
+		return nil, fmt.Errorf("kml: no placemark polygons found")
+	}
+	return orientRings(rings)
+}
+
+// kmlRing parses the coordinates of a LinearRing: tuples of longitude,
+// latitude and an optional altitude, separated by white space
+func kmlRing(coordinates string) ([]s2.Point, error) {
+	ring := make([]s2.Point, 0)
+	for _, tuple := range strings.Fields(coordinates) {
+		coords := strings.Split(tuple, ",")
+		if len(coords) < 2 || len(coords) > 3 {
+			return nil, fmt.Errorf("bad coordinates %q", tuple)
+		}
+		lng, err := strconv.ParseFloat(coords[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad coordinates %q", tuple)
+		}
+		lat, err := strconv.ParseFloat(coords[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad coordinates %q", tuple)
+		}
+		point, err := pointFromLngLat(lng, lat)
+		if err != nil {
+			return nil, err
+		}
+		ring = append(ring, point)
+	}
+	return ring, nil
+}
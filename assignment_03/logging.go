@@ -0,0 +1,22 @@
+package app
+
+import (
+	"golang.org/x/net/context"
+)
+
+// Logger is the logging interface used throughout the app. On App Engine it
+// is backed by appengine/log, everywhere else by the standard library logger.
+type Logger interface {
+	Debugf(ctx context.Context, format string, args ...interface{})
+	Infof(ctx context.Context, format string, args ...interface{})
+	Errorf(ctx context.Context, format string, args ...interface{})
+	Criticalf(ctx context.Context, format string, args ...interface{})
+}
+
+// logger is the Logger of the app, replaceable through SetLogger
+var logger Logger = defaultLogger()
+
+// SetLogger replaces the Logger used by the app
+func SetLogger(l Logger) {
+	logger = l
+}
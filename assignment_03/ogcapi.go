@@ -0,0 +1,275 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang/geo/s2"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+const (
+	// ogcCollectionID is the collection of scene footprints
+	ogcCollectionID = "footprints"
+	// ogcDefaultLimit and ogcMaxLimit are the default and largest number
+	// of features of a page of items
+	ogcDefaultLimit = 10
+	ogcMaxLimit     = 1000
+	// ogcMaxOffset is the largest offset of a page, past which a page of
+	// the whole world would read too much of the index
+	ogcMaxOffset = 10000
+	crs84        = "http://www.opengis.net/def/crs/OGC/1.3/CRS84"
+)
+
+// ogcConformance are the conformance classes of the OGC API - Features
+var ogcConformance = []string{
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/core",
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/geojson",
+}
+
+type ogcLink struct {
+	Href  string `json:"href"`
+	Rel   string `json:"rel"`
+	Type  string `json:"type,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+type ogcLandingPage struct {
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Links       []ogcLink `json:"links"`
+}
+
+type ogcCollection struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Extent      ogcExtent `json:"extent"`
+	ItemType    string    `json:"itemType"`
+	CRS         []string  `json:"crs"`
+	Links       []ogcLink `json:"links"`
+}
+
+type ogcExtent struct {
+	Spatial struct {
+		BBox [][]float64 `json:"bbox"`
+		CRS  string      `json:"crs"`
+	} `json:"spatial"`
+	Temporal struct {
+		// Interval are start and end times, nil if open
+		Interval [][]*time.Time `json:"interval"`
+		TRS      string         `json:"trs"`
+	} `json:"temporal"`
+}
+
+// ogcFeatureCollection is a page of footprints. Their number is not known,
+// as only the footprints of the page are read from the index.
+type ogcFeatureCollection struct {
+	Type           string             `json:"type"`
+	Features       []footprintFeature `json:"features"`
+	NumberReturned int                `json:"numberReturned"`
+	TimeStamp      time.Time          `json:"timeStamp"`
+	Links          []ogcLink          `json:"links"`
+}
+
+// ogcFeature is a footprint along with the links of a single item
+type ogcFeature struct {
+	footprintFeature
+	Links []ogcLink `json:"links"`
+}
+
+// ogcCollectionOf describes the collection of footprints
+func ogcCollectionOf(base string) ogcCollection {
+	path := base + "/features/collections/" + ogcCollectionID
+	c := ogcCollection{
+		ID:          ogcCollectionID,
+		Title:       "Sentinel 2 footprints",
+		Description: "Footprints of the Sentinel 2 Level-1C scenes, with their sensing time and cloud cover",
+		ItemType:    "feature",
+		CRS:         []string{crs84},
+		Links: []ogcLink{
+			{Href: path, Rel: "self", Type: "application/json"},
+			{Href: path + "/items", Rel: "items", Type: "application/geo+json", Title: "Footprints"},
+		},
+	}
+	// the first Sentinel 2 scenes were sensed on the launch of Sentinel 2A
+	start := time.Date(2015, 6, 23, 0, 0, 0, 0, time.UTC)
+	c.Extent.Spatial.BBox = [][]float64{{-180, -90, 180, 90}}
+	c.Extent.Spatial.CRS = crs84
+	c.Extent.Temporal.Interval = [][]*time.Time{{&start, nil}}
+	c.Extent.Temporal.TRS = "http://www.opengis.net/def/uom/ISO-8601/0/Gregorian"
+	return c
+}
+
+// ogcLandingHandler serves the landing page of the OGC API - Features
+func ogcLandingHandler(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r)
+	writeJSON(w, http.StatusOK, ogcLandingPage{
+		Title:       "Sentinel 2 footprints",
+		Description: "The footprints of the Sentinel 2 scenes as OGC API - Features",
+		Links: []ogcLink{
+			{Href: base + "/features", Rel: "self", Type: "application/json"},
+			{Href: base + "/features/api", Rel: "service-desc", Type: openAPIType},
+			{Href: base + "/features/conformance", Rel: "conformance", Type: "application/json"},
+			{Href: base + "/features/collections", Rel: "data", Type: "application/json"},
+		},
+	})
+}
+
+func ogcConformanceHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string][]string{"conformsTo": ogcConformance})
+}
+
+func ogcCollectionsHandler(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"links":       []ogcLink{{Href: base + "/features/collections", Rel: "self", Type: "application/json"}},
+		"collections": []ogcCollection{ogcCollectionOf(base)},
+	})
+}
+
+func ogcCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ogcCollectionOf(baseURL(r)))
+}
+
+// ogcAPIHandler serves the OpenAPI description of the OGC API - Features
+func ogcAPIHandler(w http.ResponseWriter, r *http.Request) {
+	doc := newOpenAPIDocument("Sentinel 2 footprints", baseURL(r)+"/features")
+	collection := "/collections/" + ogcCollectionID
+	doc.Paths["/"] = map[string]openAPIOperation{"get": openAPIGet("The landing page", "application/json")}
+	doc.Paths["/api"] = map[string]openAPIOperation{"get": openAPIGet("This description", openAPIType)}
+	doc.Paths["/conformance"] = map[string]openAPIOperation{"get": openAPIGet("The conformance classes", "application/json")}
+	doc.Paths["/collections"] = map[string]openAPIOperation{"get": openAPIGet("The collections", "application/json")}
+	doc.Paths[collection] = map[string]openAPIOperation{"get": openAPIGet("The collection of footprints", "application/json")}
+	doc.Paths[collection+"/items"] = map[string]openAPIOperation{"get": openAPIGet("A page of footprints, newest first", "application/geo+json",
+		openAPIQuery("bbox", "string", "west,south,east,north in degrees"),
+		openAPIQuery("datetime", "string", "a time or an interval of two times separated by a slash, either of which may be open as .."),
+		openAPIQuery("limit", "integer", fmt.Sprintf("the number of footprints of a page, at most %d", ogcMaxLimit)),
+		openAPIQuery("offset", "integer", fmt.Sprintf("the number of footprints before the page, at most %d", ogcMaxOffset)),
+	)}
+	item := openAPIGet("The footprint of a granule", "application/geo+json",
+		openAPIParameter{Name: "id", In: "path", Description: "the granule id", Required: true, Schema: openAPISchema{Type: "string"}})
+	item.Responses["404"] = openAPIResponse{Description: "No such granule"}
+	doc.Paths[collection+"/items/{id}"] = map[string]openAPIOperation{"get": item}
+	writeJSONAs(w, http.StatusOK, openAPIType, doc)
+}
+
+// ogcItemsHandler serves a page of footprints, newest first, optionally
+// within a bbox and sensed within a datetime interval. Without a bbox the
+// latest footprints of the whole world are served.
+func ogcItemsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(newContext(r), config.Timeout)
+	defer cancel()
+
+	bbox, err := parseBBox(r.FormValue("bbox"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	from, to, err := parseInterval(r.FormValue("datetime"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	limit, offset := ogcDefaultLimit, 0
+	for name, dst := range map[string]*int{"limit": &limit, "offset": &offset} {
+		value := r.FormValue(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || (name == "limit" && n == 0) {
+			writeError(w, http.StatusBadRequest, "bad parameter %s: %q", name, value)
+			return
+		}
+		*dst = n
+	}
+	if limit > ogcMaxLimit {
+		// the spec asks to serve the largest page rather than fail
+		limit = ogcMaxLimit
+	}
+	if offset > ogcMaxOffset {
+		writeError(w, http.StatusBadRequest, "bad parameter offset: %d, at most %d", offset, ogcMaxOffset)
+		return
+	}
+
+	var region s2.Region
+	if bbox != nil {
+		if region, err = bboxRect(bbox); err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+	// one more than the page, to tell whether there is a next page
+	page, err := getScenePage(ctx, region, sceneFilter{From: from, To: to}, offset, limit+1)
+	if err != nil {
+		searchFailed(ctx, w, err)
+		return
+	}
+	// clients follow the next links, so none leads past the largest offset
+	next := len(page) > limit && offset+limit <= ogcMaxOffset
+	if next {
+		page = page[:limit]
+	}
+	features := make([]footprintFeature, 0, len(page))
+	for _, s := range page {
+		features = append(features, footprintFeatureOf(s))
+	}
+
+	base := baseURL(r)
+	items := base + "/features/collections/" + ogcCollectionID + "/items"
+	self := items
+	if r.URL.RawQuery != "" {
+		self += "?" + r.URL.RawQuery
+	}
+	response := ogcFeatureCollection{
+		Type:           "FeatureCollection",
+		Features:       features,
+		NumberReturned: len(features),
+		TimeStamp:      time.Now().UTC(),
+		Links: []ogcLink{
+			{Href: self, Rel: "self", Type: "application/geo+json"},
+			{Href: base + "/features/collections/" + ogcCollectionID, Rel: "collection", Type: "application/json"},
+		},
+	}
+	if next {
+		params := url.Values{}
+		for name, values := range r.URL.Query() {
+			params[name] = values
+		}
+		params.Set("offset", strconv.Itoa(offset+limit))
+		params.Set("limit", strconv.Itoa(limit))
+		response.Links = append(response.Links, ogcLink{Href: items + "?" + params.Encode(), Rel: "next", Type: "application/geo+json"})
+	}
+	writeJSONAs(w, http.StatusOK, "application/geo+json", response)
+}
+
+// ogcItemHandler serves the footprint of a single granule
+func ogcItemHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(newContext(r), config.Timeout)
+	defer cancel()
+
+	id := mux.Vars(r)["id"]
+	s, err := getScene(ctx, id)
+	if err == errSceneNotFound {
+		writeError(w, http.StatusNotFound, "%s: %v", id, err)
+		return
+	}
+	if err != nil {
+		searchFailed(ctx, w, err)
+		return
+	}
+	base := baseURL(r)
+	collection := base + "/features/collections/" + ogcCollectionID
+	writeJSONAs(w, http.StatusOK, "application/geo+json", ogcFeature{
+		footprintFeature: footprintFeatureOf(s),
+		Links: []ogcLink{
+			{Href: collection + "/items/" + url.PathEscape(id), Rel: "self", Type: "application/geo+json"},
+			{Href: collection, Rel: "collection", Type: "application/json"},
+		},
+	})
+}
@@ -0,0 +1,80 @@
+package app
+
+// openAPIType is the media type of OpenAPI documents
+const openAPIType = "application/vnd.oai.openapi+json;version=3.0"
+
+// openAPIDocument is an OpenAPI 3.0 description of an API, served as the
+// service-desc of its landing page. Only the paths and their parameters
+// are described, not the schemas of the responses.
+type openAPIDocument struct {
+	OpenAPI string                                 `json:"openapi"`
+	Info    openAPIInfo                            `json:"info"`
+	Servers []openAPIServer                        `json:"servers"`
+	Paths   map[string]map[string]openAPIOperation `json:"paths"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIServer struct {
+	URL string `json:"url"`
+}
+
+type openAPIOperation struct {
+	Summary     string                     `json:"summary"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIBody               `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string        `json:"name"`
+	In          string        `json:"in"`
+	Description string        `json:"description,omitempty"`
+	Required    bool          `json:"required,omitempty"`
+	Schema      openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Type string `json:"type"`
+}
+
+type openAPIBody struct {
+	Required bool                `json:"required"`
+	Content  map[string]struct{} `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string              `json:"description"`
+	Content     map[string]struct{} `json:"content,omitempty"`
+}
+
+// newOpenAPIDocument returns the description of the API served at url
+func newOpenAPIDocument(title, url string) openAPIDocument {
+	return openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: title, Version: "1.0.0"},
+		Servers: []openAPIServer{{URL: url}},
+		Paths:   make(map[string]map[string]openAPIOperation),
+	}
+}
+
+// openAPIGet describes an operation responding with a document of the
+// media type
+func openAPIGet(summary, mediaType string, params ...openAPIParameter) openAPIOperation {
+	return openAPIOperation{
+		Summary:    summary,
+		Parameters: params,
+		Responses: map[string]openAPIResponse{
+			"200": {Description: summary, Content: map[string]struct{}{mediaType: {}}},
+			"400": {Description: "Bad parameters"},
+		},
+	}
+}
+
+// openAPIQuery describes a query parameter of the type
+func openAPIQuery(name, typ, description string) openAPIParameter {
+	return openAPIParameter{Name: name, In: "query", Description: description, Schema: openAPISchema{Type: typ}}
+}
@@ -0,0 +1,134 @@
+// +build appengine
+
+package app
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/runtime"
+	"google.golang.org/appengine/socket"
+	"google.golang.org/appengine/urlfetch"
+)
+
+// On App Engine the config comes from the env_variables of app.yaml, and the
+// routes are registered on the default mux, which the runtime serves
+func init() {
+	c, err := LoadConfig(os.Getenv("SWS_CONFIG"), nil)
+	if err != nil {
+		panic(err)
+	}
+	if err := Configure(c); err != nil {
+		panic(err)
+	}
+	http.Handle("/", requestBigQueryClient(NewRouter()))
+}
+
+// requestBigQueryClient gives every request its own BigQuery client, as
+// outgoing calls on App Engine are bound to the context of a request,
+// so a client shared by the process would not outlive its first request
+func requestBigQueryClient(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		client, err := bigquery.NewClient(ctx, config.ProjectID, config.clientOptions()...)
+		if err != nil {
+			log.Errorf(ctx, "Failed to create client: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer client.Close()
+		h.ServeHTTP(w, r.WithContext(WithBigQueryClient(r.Context(), client)))
+	})
+}
+
+func newContext(r *http.Request) context.Context {
+	ctx := appengine.NewContext(r)
+	if client, ok := r.Context().Value(bigQueryKey{}).(*bigquery.Client); ok {
+		ctx = WithBigQueryClient(ctx, client)
+	}
+	return ctx
+}
+
+// httpClient returns an http.Client using urlfetch, since App Engine
+// does not allow outbound connections from the standard client
+func httpClient(ctx context.Context) *http.Client {
+	return urlfetch.Client(ctx)
+}
+
+// callbackClient is the client of job callbacks, which urlfetch sends from
+// outside the network of the app
+func callbackClient(ctx context.Context) *http.Client {
+	return urlfetch.Client(ctx)
+}
+
+// lookupIP returns the addresses of host, resolved through the socket
+// service as App Engine allows no lookups of its own
+func lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return socket.LookupIP(ctx, host)
+}
+
+// runInBackground runs f outliving the request of ctx, with a BigQuery
+// client of its own. App Engine only allows this on instances with manual
+// or basic scaling.
+func runInBackground(ctx context.Context, f func(ctx context.Context)) error {
+	return runtime.RunInBackground(ctx, func(ctx context.Context) {
+		client, err := bigquery.NewClient(ctx, config.ProjectID, config.clientOptions()...)
+		if err != nil {
+			// f still runs, so that it fails as its queries do
+			log.Errorf(ctx, "Failed to create client: %v", err)
+			f(ctx)
+			return
+		}
+		defer client.Close()
+		f(WithBigQueryClient(ctx, client))
+	})
+}
+
+// openJobStore fails on App Engine, which has no disk to keep jobs on
+func openJobStore(path string) (JobStore, error) {
+	return nil, errors.New("a job store file is not supported on App Engine")
+}
+
+// runDetached fails on App Engine, which only allows calls to its services
+// within requests
+func runDetached(f func(ctx context.Context)) error {
+	return errors.New("work outside of requests is not supported on App Engine")
+}
+
+// every does nothing on App Engine, which only allows work within requests
+func every(interval time.Duration, f func(ctx context.Context)) {}
+
+// subscriptionsSupported fails on App Engine, where every instance would
+// keep subscriptions of its own in memory, having no disk to share them on
+func subscriptionsSupported() error {
+	return errors.New("subscriptions are not supported on App Engine")
+}
+
+type appengineLogger struct{}
+
+func defaultLogger() Logger {
+	return appengineLogger{}
+}
+
+func (appengineLogger) Debugf(ctx context.Context, format string, args ...interface{}) {
+	log.Debugf(ctx, format, args...)
+}
+
+func (appengineLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	log.Infof(ctx, format, args...)
+}
+
+func (appengineLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	log.Errorf(ctx, format, args...)
+}
+
+func (appengineLogger) Criticalf(ctx context.Context, format string, args ...interface{}) {
+	log.Criticalf(ctx, format, args...)
+}
@@ -0,0 +1,118 @@
+// +build !appengine
+
+package app
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// client is shared by all outgoing requests, so connections are reused
+var client = &http.Client{}
+
+func newContext(r *http.Request) context.Context {
+	return r.Context()
+}
+
+func httpClient(ctx context.Context) *http.Client {
+	return client
+}
+
+// callbacks is the client of job callbacks. Unless the host of a callback
+// is one of the CallbackHosts of the config, its addresses are checked to be
+// public as it is dialled, so that a host cannot resolve to another address
+// than when its callback was validated.
+var callbacks = &http.Client{Transport: &http.Transport{
+	DialContext:         dialCallback,
+	TLSHandshakeTimeout: 10 * time.Second,
+}}
+
+func callbackClient(ctx context.Context) *http.Client {
+	return callbacks
+}
+
+func dialCallback(ctx context.Context, network, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if callbackHostAllowed(host) {
+		return dialer.DialContext(ctx, network, address)
+	}
+	ips, err := publicAddresses(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("refusing to connect: %v", err)
+	}
+	return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+}
+
+// lookupIP returns the addresses of host
+func lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// runInBackground runs f in a goroutine outliving the request of ctx
+func runInBackground(ctx context.Context, f func(ctx context.Context)) error {
+	go f(context.Background())
+	return nil
+}
+
+// runDetached runs f in a goroutine of its own, outside of any request
+func runDetached(f func(ctx context.Context)) error {
+	go f(context.Background())
+	return nil
+}
+
+// every calls f every interval, in a goroutine outliving the caller
+func every(interval time.Duration, f func(ctx context.Context)) {
+	go func() {
+		for range time.Tick(interval) {
+			f(context.Background())
+		}
+	}()
+}
+
+// subscriptionsSupported always succeeds outside App Engine
+func subscriptionsSupported() error {
+	return nil
+}
+
+// stdLogger logs through the standard library logger, prefixing the level
+type stdLogger struct {
+	*log.Logger
+}
+
+func defaultLogger() Logger {
+	return stdLogger{log.New(os.Stderr, "", log.LstdFlags)}
+}
+
+func (l stdLogger) Debugf(ctx context.Context, format string, args ...interface{}) {
+	l.Printf("DEBUG "+format, args...)
+}
+
+func (l stdLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	l.Printf("INFO "+format, args...)
+}
+
+func (l stdLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	l.Printf("ERROR "+format, args...)
+}
+
+func (l stdLogger) Criticalf(ctx context.Context, format string, args ...interface{}) {
+	l.Printf("CRITICAL "+format, args...)
+}
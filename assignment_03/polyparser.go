@@ -1,54 +1,206 @@
 package app
 
 import (
-    "github.com/golang/geo/s2"
-    "log"
-    "strconv"
-    "strings"
-    "bufio"
-    "io"
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/golang/geo/s2"
 )
 
-// ParsePolyFile ... 
-func ParsePolyFile(reader io.Reader) [][]s2.Point{
-    polygons := make([][]s2.Point, 0)
-    scanner := bufio.NewScanner(reader)
-
-    polygon := make([]s2.Point, 0)
-    for scanner.Scan() {
-        words := strings.Fields(scanner.Text())
-        if len(words) == 1 {
-            if len(polygon) != 0 {
-                polygons = append(polygons, polygon)
-                polygon = make([]s2.Point, 0)
-            }
-        } else { 
-            x, _ := strconv.ParseFloat(words[0], 64)
-            y, _ := strconv.ParseFloat(words[1], 64)
-            p := s2.PointFromLatLng(s2.LatLngFromDegrees(x, y))
-            polygon = append(polygon, p)
-        }
-        if scanErr := scanner.Err(); scanErr != nil {
-            log.Fatal(scanErr)
-        }
-    } 
-
-    return polygons
-}
-
-
-// CellsFromPolygons ...
-func CellsFromPolygons(polygons [][]s2.Point) []s2.Cell {
-    cells := make([]s2.Cell, 0)
-    for _, points := range polygons {
-        l1 := s2.LoopFromPoints(points) 
-        loops := []*s2.Loop{l1} 
-        poly := s2.PolygonFromLoops(loops) 
-        rc := &s2.RegionCoverer{MaxLevel: 30, MaxCells: 10}
-        cover := rc.Covering(poly)
-        for _, cid := range cover {
-            cells = append(cells, s2.CellFromCellID(cid))
-        }
-    }
-    return cells
+// Poly is a polygon in the Osmosis polygon filter format, as used by the
+// extracts of Geofabrik. It consists of a name and a set of named rings.
+type Poly struct {
+	Name  string
+	Rings []PolyRing
+}
+
+// PolyRing is a section of a .poly file. Sections named with a leading "!"
+// are holes, cut out of the outer rings.
+type PolyRing struct {
+	Name string
+	Hole bool
+	// Coords are the vertices exactly as written in the file
+	Coords [][2]float64
+}
+
+// PolyError is an error in a .poly file, at the given line
+type PolyError struct {
+	Line int
+	Err  string
+}
+
+func (e *PolyError) Error() string {
+	return fmt.Sprintf("poly: line %d: %s", e.Line, e.Err)
+}
+
+// ParsePoly parses a file in the Osmosis .poly format:
+//
+//	name
+//	section
+//	   x   y
+//	   ...
+//	END
+//	!hole section
+//	   ...
+//	END
+//	END
+func ParsePoly(reader io.Reader) (*Poly, error) {
+	scanner := bufio.NewScanner(reader)
+	poly := &Poly{}
+	line := 0
+	errorf := func(format string, args ...interface{}) error {
+		return &PolyError{Line: line, Err: fmt.Sprintf(format, args...)}
+	}
+
+	var ring *PolyRing
+	named, ended := false, false
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		switch {
+		case ended:
+			return nil, errorf("unexpected %q after the END of the file", text)
+		case !named:
+			poly.Name = text
+			named = true
+		case ring == nil && text == "END":
+			ended = true
+		case ring == nil:
+			if len(strings.Fields(text)) != 1 {
+				return nil, errorf("expected a section name or END, got %q", text)
+			}
+			ring = &PolyRing{Name: strings.TrimPrefix(text, "!"), Hole: strings.HasPrefix(text, "!")}
+		case text == "END":
+			poly.Rings = append(poly.Rings, *ring)
+			ring = nil
+		default:
+			words := strings.Fields(text)
+			if len(words) != 2 {
+				return nil, errorf("expected two coordinates, got %q", text)
+			}
+			x, err := strconv.ParseFloat(words[0], 64)
+			if err != nil {
+				return nil, errorf("bad coordinate %q", words[0])
+			}
+			y, err := strconv.ParseFloat(words[1], 64)
+			if err != nil {
+				return nil, errorf("bad coordinate %q", words[1])
+			}
+			ring.Coords = append(ring.Coords, [2]float64{x, y})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case !named:
+		return nil, errorf("empty file")
+	case ring != nil:
+		return nil, errorf("section %q is missing its END", ring.Name)
+	case !ended:
+		return nil, errorf("file is missing its END")
+	}
+	return poly, nil
+}
+
+// Write writes the polygon in the .poly format, such that parsing the
+// output gives back the same polygon
+func (p *Poly) Write(writer io.Writer) error {
+	w := bufio.NewWriter(writer)
+	fmt.Fprintln(w, p.Name)
+	for _, ring := range p.Rings {
+		if ring.Hole {
+			fmt.Fprint(w, "!")
+		}
+		fmt.Fprintln(w, ring.Name)
+		for _, c := range ring.Coords {
+			fmt.Fprintf(w, "   %s   %s\n",
+				strconv.FormatFloat(c[0], 'E', -1, 64),
+				strconv.FormatFloat(c[1], 'E', -1, 64))
+		}
+		fmt.Fprintln(w, "END")
+	}
+	fmt.Fprintln(w, "END")
+	return w.Flush()
+}
+
+// Loops returns the vertices of every ring of the polygon, outer rings and
+// holes alike, as normalized by normalizeRing. The coordinates of .poly files
+// are given as longitude latitude.
+//
+// PolygonFromPoints tells holes from outer rings by their nesting, so holes
+// must lie within an outer ring, and outer rings must not lie within another
+// outer ring unless there is a hole in between.
+func (p *Poly) Loops() ([][]s2.Point, error) {
+	polygons := make([][]s2.Point, 0, len(p.Rings))
+	for _, ring := range p.Rings {
+		polygon := make([]s2.Point, 0, len(ring.Coords))
+		for _, c := range ring.Coords {
+			point, err := pointFromLngLat(c[0], c[1])
+			if err != nil {
+				return nil, fmt.Errorf("poly: section %q: %v", ring.Name, err)
+			}
+			polygon = append(polygon, point)
+		}
+		polygon, err := normalizeRing(polygon)
+		if err != nil {
+			return nil, fmt.Errorf("poly: section %q: %v", ring.Name, err)
+		}
+		polygons = append(polygons, polygon)
+	}
+	if err := p.checkNesting(polygons); err != nil {
+		return nil, err
+	}
+	return polygons, nil
+}
+
+// checkNesting checks that the rings within an odd number of other rings are
+// exactly the holes
+func (p *Poly) checkNesting(polygons [][]s2.Point) error {
+	loops := make([]*s2.Loop, 0, len(polygons))
+	for _, points := range polygons {
+		loops = append(loops, s2.LoopFromPoints(points))
+	}
+	for i, loop := range loops {
+		depth := 0
+		for j, other := range loops {
+			if i != j && other.Contains(loop) {
+				depth++
+			}
+		}
+		switch ring := p.Rings[i]; {
+		case ring.Hole && depth%2 == 0:
+			return fmt.Errorf("poly: hole %q is not within an outer section", ring.Name)
+		case !ring.Hole && depth%2 == 1:
+			return fmt.Errorf("poly: section %q is within another outer section", ring.Name)
+		}
+	}
+	return nil
+}
+
+// ParsePolyFile parses a .poly file, returning the vertices of its rings
+func ParsePolyFile(reader io.Reader) ([][]s2.Point, error) {
+	poly, err := ParsePoly(reader)
+	if err != nil {
+		return nil, err
+	}
+	return poly.Loops()
+}
+
+// PolygonFromPoints builds a single polygon of all the given loops, in which
+// loops within other loops are holes. The loops must be normalized.
+func PolygonFromPoints(polygons [][]s2.Point) *s2.Polygon {
+	loops := make([]*s2.Loop, 0, len(polygons))
+	for _, points := range polygons {
+		loops = append(loops, s2.LoopFromPoints(points))
+	}
+	return s2.PolygonFromLoops(loops)
 }
@@ -0,0 +1,211 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/geo/s2"
+)
+
+func pointAt(lng, lat float64) s2.Point {
+	return s2.PointFromLatLng(s2.LatLngFromDegrees(lat, lng))
+}
+
+func parsePolyFixture(t *testing.T, name string) ([][]s2.Point, error) {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	return ParsePolyFile(f)
+}
+
+func TestParsePolyFile(t *testing.T) {
+	tests := []struct {
+		file    string
+		rings   int
+		inside  [][2]float64
+		outside [][2]float64
+	}{
+		{
+			file:    "islands.poly",
+			rings:   2,
+			inside:  [][2]float64{{10.5, 55.5}, {12.5, 55.5}},
+			outside: [][2]float64{{11.5, 55.5}, {-169.5, -55.5}},
+		},
+		{
+			// the outer ring is clockwise, which .poly files do not forbid
+			file:    "hole.poly",
+			rings:   2,
+			inside:  [][2]float64{{10.5, 50.5}, {13.5, 53.5}},
+			outside: [][2]float64{{12, 52}, {20, 52}},
+		},
+		{
+			file:    "antimeridian.poly",
+			rings:   1,
+			inside:  [][2]float64{{179.5, -17}, {-179.5, -17}},
+			outside: [][2]float64{{0, -17}, {177.5, -17}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			rings, err := parsePolyFixture(t, test.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rings) != test.rings {
+				t.Fatalf("got %d rings, want %d", len(rings), test.rings)
+			}
+			for _, ring := range rings {
+				if len(ring) != 4 {
+					t.Errorf("ring has %d vertices, want the 4 without the closing one", len(ring))
+				}
+			}
+			polygon := PolygonFromPoints(rings)
+			for _, c := range test.inside {
+				if !polygon.ContainsPoint(pointAt(c[0], c[1])) {
+					t.Errorf("(%v %v) is not within the polygon", c[0], c[1])
+				}
+			}
+			for _, c := range test.outside {
+				if polygon.ContainsPoint(pointAt(c[0], c[1])) {
+					t.Errorf("(%v %v) is within the polygon", c[0], c[1])
+				}
+			}
+		})
+	}
+}
+
+// south-africa.poly is laid out like the Geofabrik extracts, at a coarser
+// resolution, with the Prince Edward Islands as a second outer ring and
+// Lesotho cut out as a hole
+func TestParsePolyFileCountry(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "south-africa.poly"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	poly, err := ParsePoly(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if poly.Name != "south-africa" || len(poly.Rings) != 3 || !poly.Rings[2].Hole {
+		t.Fatalf("got %q with %d sections, want south-africa with Lesotho as its third", poly.Name, len(poly.Rings))
+	}
+	rings, err := poly.Loops()
+	if err != nil {
+		t.Fatal(err)
+	}
+	polygon := PolygonFromPoints(rings)
+
+	places := []struct {
+		name     string
+		lng, lat float64
+		inside   bool
+	}{
+		{"Johannesburg", 28.05, -26.2, true},
+		{"Bloemfontein", 26.2, -29.1, true},
+		{"Worcester", 19.45, -33.65, true},
+		{"Marion Island", 37.75, -46.9, true},
+		{"Thaba-Tseka, Lesotho", 28.6, -29.5, false},
+		{"Windhoek, Namibia", 17.08, -22.56, false},
+		{"Maputo, Mozambique", 32.58, -25.97, false},
+		{"Indian Ocean", 33, -31, false},
+		{"Copenhagen", 12.57, 55.68, false},
+	}
+	for _, p := range places {
+		if polygon.ContainsPoint(pointAt(p.lng, p.lat)) != p.inside {
+			t.Errorf("%s (%v %v): got inside %v, want %v", p.name, p.lng, p.lat, !p.inside, p.inside)
+		}
+	}
+}
+
+func TestParsePolyFileBowTie(t *testing.T) {
+	_, err := parsePolyFixture(t, "bowtie.poly")
+	if err == nil || !strings.Contains(err.Error(), "intersects itself") {
+		t.Fatalf("got error %v, want a self intersection", err)
+	}
+}
+
+func TestParsePolyFileNesting(t *testing.T) {
+	square := func(name string, min, max float64) string {
+		return fmt.Sprintf("%s\n   %v %v\n   %v %v\n   %v %v\n   %v %v\nEND\n",
+			name, min, min, max, min, max, max, min, max)
+	}
+	tests := []struct {
+		name     string
+		sections string
+		err      string
+	}{
+		{"hole outside the outer ring", square("1", 0, 1) + square("!2", 5, 6), "not within an outer section"},
+		{"hole alone", square("!1", 5, 6), "not within an outer section"},
+		{"outer ring within another", square("1", 0, 4) + square("2", 1, 2), "within another outer section"},
+		{"island in a lake", square("1", 0, 4) + square("!2", 1, 3) + square("3", 1.5, 2.5), ""},
+	}
+	for _, test := range tests {
+		_, err := ParsePolyFile(strings.NewReader("name\n" + test.sections + "END\n"))
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: got error %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestParsePolyErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		line  int
+	}{
+		{"", 0},
+		{"name\n1\n   1.0   2.0\nEND\n", 4},
+		{"name\n1\n   1.0\nEND\nEND\n", 3},
+		{"name\n1\n   1.0   x\nEND\nEND\n", 3},
+		{"name\nEND\nmore\n", 3},
+	}
+	for _, test := range tests {
+		_, err := ParsePoly(strings.NewReader(test.input))
+		polyErr, ok := err.(*PolyError)
+		if !ok {
+			t.Errorf("%q: got error %v, want a PolyError", test.input, err)
+			continue
+		}
+		if polyErr.Line != test.line {
+			t.Errorf("%q: got an error at line %d, want line %d: %v", test.input, polyErr.Line, test.line, err)
+		}
+	}
+}
+
+func TestPolyWrite(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "hole.poly"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	poly, err := ParsePoly(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !poly.Rings[1].Hole || poly.Rings[1].Name != "lake" {
+		t.Errorf("got second section %q, hole %v, want the hole lake", poly.Rings[1].Name, poly.Rings[1].Hole)
+	}
+
+	var b bytes.Buffer
+	if err := poly.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	written, err := ParsePoly(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(written, poly) {
+		t.Errorf("got %+v after writing, want %+v", written, poly)
+	}
+}
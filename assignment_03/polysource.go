@@ -0,0 +1,221 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// PolygonSource provides the polygons of countries, by region and country
+// as named in the extracts of Geofabrik, e.g. europe/denmark
+type PolygonSource interface {
+	// Poly returns the polygon of the country in the region,
+	// or errPolygonNotFound
+	Poly(ctx context.Context, region, country string) (*Poly, error)
+	// Regions lists the countries known to the source, by region
+	Regions(ctx context.Context) (map[string][]string, error)
+}
+
+var errPolygonNotFound = errors.New("polygon not found")
+
+// polyNamePattern matches valid region and country names, keeping them
+// from escaping the library directory or the Geofabrik site
+var polyNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+func validatePolyName(region, country string) error {
+	if !polyNamePattern.MatchString(region) {
+		return fmt.Errorf("bad region %q", region)
+	}
+	if !polyNamePattern.MatchString(country) {
+		return fmt.Errorf("bad country %q", country)
+	}
+	return nil
+}
+
+// polygonSource is the PolygonSource of the app, set up by Configure
+var polygonSource = newPolygonSource(config)
+
+// newPolygonSource returns the library of the config, falling back to
+// Geofabrik if enabled
+func newPolygonSource(c *Config) PolygonSource {
+	sources := polygonSources{}
+	if c.PolyDir != "" {
+		sources = append(sources, dirPolygonSource(c.PolyDir))
+	}
+	if c.GeofabrikFallback {
+		sources = append(sources, newGeofabrikSource(geofabrikURL))
+	}
+	return sources
+}
+
+// dirPolygonSource is a library of pre-downloaded .poly files,
+// laid out as <dir>/<region>/<country>.poly
+type dirPolygonSource string
+
+func (dir dirPolygonSource) Poly(ctx context.Context, region, country string) (*Poly, error) {
+	if err := validatePolyName(region, country); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filepath.Join(string(dir), region, country+".poly"))
+	if os.IsNotExist(err) {
+		return nil, errPolygonNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParsePoly(file)
+}
+
+func (dir dirPolygonSource) Regions(ctx context.Context) (map[string][]string, error) {
+	regions := make(map[string][]string)
+	dirs, err := ioutil.ReadDir(string(dir))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() || !polyNamePattern.MatchString(d.Name()) {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(string(dir), d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			country := strings.TrimSuffix(f.Name(), ".poly")
+			if f.Mode().IsRegular() && country != f.Name() && polyNamePattern.MatchString(country) {
+				regions[d.Name()] = append(regions[d.Name()], country)
+			}
+		}
+	}
+	return regions, nil
+}
+
+const geofabrikURL = "http://download.geofabrik.de"
+
+// geofabrikError is a failure to download a polygon from Geofabrik, or a
+// polygon of Geofabrik which is not valid, as opposed to a failure of the
+// library of the app
+type geofabrikError struct {
+	err error
+}
+
+func (e geofabrikError) Error() string {
+	return "geofabrik: " + e.err.Error()
+}
+
+// geofabrikSource downloads polygons from Geofabrik, keeping those
+// downloaded in memory. Polygons whose rings are not valid are refused
+// rather than kept.
+type geofabrikSource struct {
+	baseURL string
+
+	mu    sync.Mutex
+	cache map[string]*Poly
+}
+
+func newGeofabrikSource(baseURL string) *geofabrikSource {
+	return &geofabrikSource{baseURL: baseURL, cache: make(map[string]*Poly)}
+}
+
+func (g *geofabrikSource) Poly(ctx context.Context, region, country string) (*Poly, error) {
+	if err := validatePolyName(region, country); err != nil {
+		return nil, err
+	}
+	key := region + "/" + country
+
+	g.mu.Lock()
+	poly, ok := g.cache[key]
+	g.mu.Unlock()
+	if ok {
+		return poly, nil
+	}
+
+	url := fmt.Sprintf("%s/%s.poly", g.baseURL, key)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := httpClient(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, geofabrikError{err}
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return nil, errPolygonNotFound
+	case res.StatusCode != http.StatusOK:
+		return nil, geofabrikError{fmt.Errorf("%s: %s", url, res.Status)}
+	}
+	if poly, err = ParsePoly(res.Body); err != nil {
+		return nil, geofabrikError{fmt.Errorf("%s: %v", url, err)}
+	}
+	if _, err := poly.Loops(); err != nil {
+		return nil, geofabrikError{fmt.Errorf("%s: %v", url, err)}
+	}
+
+	g.mu.Lock()
+	g.cache[key] = poly
+	g.mu.Unlock()
+	return poly, nil
+}
+
+// Regions lists the polygons downloaded so far, as Geofabrik has no
+// listing of its polygons
+func (g *geofabrikSource) Regions(ctx context.Context) (map[string][]string, error) {
+	regions := make(map[string][]string)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for key := range g.cache {
+		parts := strings.SplitN(key, "/", 2)
+		regions[parts[0]] = append(regions[parts[0]], parts[1])
+	}
+	return regions, nil
+}
+
+// polygonSources tries each of its sources in turn
+type polygonSources []PolygonSource
+
+func (sources polygonSources) Poly(ctx context.Context, region, country string) (*Poly, error) {
+	for _, source := range sources {
+		poly, err := source.Poly(ctx, region, country)
+		if err != errPolygonNotFound {
+			return poly, err
+		}
+	}
+	return nil, errPolygonNotFound
+}
+
+// Regions merges the listings of all sources, sorting the countries of each region
+func (sources polygonSources) Regions(ctx context.Context) (map[string][]string, error) {
+	regions := make(map[string][]string)
+	for _, source := range sources {
+		r, err := source.Regions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for region, countries := range r {
+			regions[region] = append(regions[region], countries...)
+		}
+	}
+	for region, countries := range regions {
+		sort.Strings(countries)
+		unique := countries[:0]
+		for i, country := range countries {
+			if i == 0 || country != countries[i-1] {
+				unique = append(unique, country)
+			}
+		}
+		regions[region] = unique
+	}
+	return regions, nil
+}
@@ -0,0 +1,139 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/golang/geo/s2"
+)
+
+// pointFromLngLat converts a vertex given as longitude and latitude, the order
+// used by the .poly, GeoJSON, WKT and KML formats alike, into an s2.Point
+func pointFromLngLat(lng, lat float64) (s2.Point, error) {
+	if lat < -90 || lat > 90 {
+		return s2.Point{}, fmt.Errorf("latitude %v of (%v %v) is out of range, "+
+			"coordinates must be given as longitude latitude", lat, lng, lat)
+	}
+	if lng < -180 || lng > 180 {
+		return s2.Point{}, fmt.Errorf("longitude %v of (%v %v) is out of range", lng, lng, lat)
+	}
+	return s2.PointFromLatLng(s2.LatLngFromDegrees(lat, lng)), nil
+}
+
+// cleanRing turns the vertices of a ring into those of a valid s2 loop.
+//
+// Rings are commonly closed by repeating the first vertex, and may contain
+// repeated vertices and spikes going back and forth along an edge. These
+// are repaired by dropping the duplicates and spikes. Rings which cannot be
+// repaired, such as those intersecting themselves, are rejected.
+func cleanRing(points []s2.Point) ([]s2.Point, *s2.Loop, error) {
+	ring := make([]s2.Point, 0, len(points))
+	for _, p := range points {
+		if n := len(ring); n > 0 && ring[n-1].ApproxEqual(p) {
+			continue
+		}
+		// a spike a b a is reduced to a
+		if n := len(ring); n > 1 && ring[n-2].ApproxEqual(p) {
+			ring = ring[:n-1]
+			continue
+		}
+		ring = append(ring, p)
+	}
+	// drop the closing vertices, along with any spike at the seam
+	for len(ring) > 1 && ring[0].ApproxEqual(ring[len(ring)-1]) {
+		ring = ring[:len(ring)-1]
+	}
+	for len(ring) > 2 && ring[1].ApproxEqual(ring[len(ring)-1]) {
+		ring = ring[1 : len(ring)-1]
+	}
+
+	if len(ring) < 3 {
+		return nil, nil, fmt.Errorf("ring has %d distinct vertices, at least 3 are needed", len(ring))
+	}
+
+	loop := s2.LoopFromPoints(ring)
+	if err := loop.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if i, j, ok := findSelfIntersection(loop); ok {
+		return nil, nil, fmt.Errorf("ring intersects itself at edges %d and %d", i, j)
+	}
+	return ring, loop, nil
+}
+
+// normalizeRing repairs a ring like cleanRing, for formats such as .poly
+// which leave the winding of their rings unspecified. The vertices are
+// reversed if needed, so that the loop is counter clockwise around the
+// smaller of the two areas it divides the sphere into.
+func normalizeRing(points []s2.Point) ([]s2.Point, error) {
+	ring, loop, err := cleanRing(points)
+	if err != nil {
+		return nil, err
+	}
+	if !loop.IsNormalized() {
+		reverse(ring)
+	}
+	return ring, nil
+}
+
+// windingRing is a ring of a format specifying its winding, such as GeoJSON,
+// WKT and KML: outer rings are counter clockwise around the area they
+// enclose, and holes clockwise around the area they cut out.
+type windingRing struct {
+	points []s2.Point
+	hole   bool
+}
+
+// orientRing repairs a ring like cleanRing, keeping the winding it was
+// given, so that outer rings enclosing more than a hemisphere keep doing so.
+// Holes are reversed, as s2 expects every loop to be counter clockwise
+// around its own area.
+func orientRing(r windingRing) ([]s2.Point, error) {
+	ring, _, err := cleanRing(r.points)
+	if err != nil {
+		return nil, err
+	}
+	if r.hole {
+		reverse(ring)
+	}
+	return ring, nil
+}
+
+func reverse(ring []s2.Point) {
+	for i, j := 0, len(ring)-1; i < j; i, j = i+1, j-1 {
+		ring[i], ring[j] = ring[j], ring[i]
+	}
+}
+
+// findSelfIntersection reports whether any two edges of the loop cross,
+// returning the first pair found
+func findSelfIntersection(loop *s2.Loop) (int, int, bool) {
+	index := s2.NewShapeIndex()
+	index.Add(loop)
+	query := s2.NewCrossingEdgeQuery(index)
+	for i := 0; i < loop.NumEdges(); i++ {
+		edge := loop.Edge(i)
+		for _, j := range query.Crossings(edge.V0, edge.V1, loop, s2.CrossingTypeInterior) {
+			if j != i {
+				return i, j, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// orientRings orients every ring with orientRing
+func orientRings(rings []windingRing) ([][]s2.Point, error) {
+	if len(rings) == 0 {
+		return nil, errors.New("no rings given")
+	}
+	oriented := make([][]s2.Point, 0, len(rings))
+	for i, ring := range rings {
+		points, err := orientRing(ring)
+		if err != nil {
+			return nil, fmt.Errorf("ring %d: %v", i+1, err)
+		}
+		oriented = append(oriented, points)
+	}
+	return oriented, nil
+}
@@ -0,0 +1,107 @@
+package app
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/golang/geo/s2"
+)
+
+// lngLats returns the points of the given longitudes and latitudes
+func lngLats(coords ...[2]float64) []s2.Point {
+	points := make([]s2.Point, 0, len(coords))
+	for _, c := range coords {
+		points = append(points, pointAt(c[0], c[1]))
+	}
+	return points
+}
+
+func TestNormalizeRing(t *testing.T) {
+	// clockwise, closed, with a repeated vertex and a spike
+	ring := lngLats([2]float64{0, 0}, [2]float64{0, 1}, [2]float64{0, 1}, [2]float64{1, 1},
+		[2]float64{1.5, 1}, [2]float64{1, 1}, [2]float64{1, 0}, [2]float64{0, 0})
+	normalized, err := normalizeRing(ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(normalized) != 4 {
+		t.Errorf("got %d vertices, want 4", len(normalized))
+	}
+	polygon := PolygonFromPoints([][]s2.Point{normalized})
+	if !polygon.ContainsPoint(pointAt(0.5, 0.5)) {
+		t.Errorf("the normalized ring does not contain its area")
+	}
+}
+
+func TestParseWKTWinding(t *testing.T) {
+	tests := []struct {
+		wkt     string
+		inside  [][2]float64
+		outside [][2]float64
+	}{
+		{
+			// counter clockwise around all but the antimeridian
+			wkt:     "POLYGON((-170 -80,170 -80,170 80,-170 80,-170 -80))",
+			inside:  [][2]float64{{0, 0}, {90, 45}},
+			outside: [][2]float64{{180, 0}, {175, 10}},
+		},
+		{
+			// clockwise, so around the antimeridian
+			wkt:     "POLYGON((-170 -80,-170 80,170 80,170 -80,-170 -80))",
+			inside:  [][2]float64{{180, 0}, {175, 10}},
+			outside: [][2]float64{{0, 0}, {90, 45}},
+		},
+		{
+			wkt:     "POLYGON((10 50,14 50,14 54,10 54,10 50),(11 51,11 53,13 53,13 51,11 51))",
+			inside:  [][2]float64{{10.5, 50.5}},
+			outside: [][2]float64{{12, 52}, {20, 52}},
+		},
+	}
+	for _, test := range tests {
+		rings, err := ParseWKT(strings.NewReader(test.wkt))
+		if err != nil {
+			t.Errorf("%s: %v", test.wkt, err)
+			continue
+		}
+		polygon := PolygonFromPoints(rings)
+		for _, c := range test.inside {
+			if !polygon.ContainsPoint(pointAt(c[0], c[1])) {
+				t.Errorf("%s: (%v %v) is not within the polygon", test.wkt, c[0], c[1])
+			}
+		}
+		for _, c := range test.outside {
+			if polygon.ContainsPoint(pointAt(c[0], c[1])) {
+				t.Errorf("%s: (%v %v) is within the polygon", test.wkt, c[0], c[1])
+			}
+		}
+	}
+}
+
+func TestParseGeoJSONRightHandRule(t *testing.T) {
+	input := `{"type": "Feature", "geometry": {"type": "Polygon", "coordinates": [
+		[[-170, -80], [170, -80], [170, 80], [-170, 80], [-170, -80]],
+		[[10, 10], [10, 20], [20, 20], [20, 10], [10, 10]]
+	]}}`
+	rings, err := ParseGeoJSON(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	polygon := PolygonFromPoints(rings)
+	if area := polygon.Area(); area < 2*math.Pi {
+		t.Errorf("got an area of %v, want more than a hemisphere", area)
+	}
+	if !polygon.ContainsPoint(pointAt(0, 0)) {
+		t.Errorf("(0 0) is not within the polygon")
+	}
+	if polygon.ContainsPoint(pointAt(15, 15)) {
+		t.Errorf("(15 15) is within the hole of the polygon")
+	}
+}
+
+func TestOrientRingBowTie(t *testing.T) {
+	ring := lngLats([2]float64{0, 0}, [2]float64{2, 2}, [2]float64{2, 0}, [2]float64{0, 2})
+	if _, err := orientRing(windingRing{points: ring}); err == nil {
+		t.Errorf("a bow-tie was accepted")
+	}
+}
@@ -0,0 +1,566 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/golang/geo/s2"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+)
+
+var errSceneNotFound = errors.New("scene not found")
+
+// sceneColumns are the columns of the index selected for a sceneRow
+const sceneColumns = `granule_id, product_id, mgrs_tile, sensing_time, cloud_cover,
+			north_lat, south_lat, east_lon, west_lon, base_url`
+
+// sceneRow is a row of the sentinel 2 index, as read from BigQuery
+type sceneRow struct {
+	Granule_id   string
+	Product_id   string
+	Mgrs_tile    string
+	Sensing_time time.Time
+	Cloud_cover  bigquery.NullFloat64
+	North_lat    float64
+	South_lat    float64
+	East_lon     float64
+	West_lon     float64
+	Base_url     string
+}
+
+// scene is a granule of the index along with its footprint
+type scene struct {
+	GranuleID   string    `json:"granule_id"`
+	ProductID   string    `json:"product_id"`
+	MgrsTile    string    `json:"mgrs_tile"`
+	SensingTime time.Time `json:"sensing_time"`
+	CloudCover  float64   `json:"cloud_cover"`
+	NorthLat    float64   `json:"north_lat"`
+	SouthLat    float64   `json:"south_lat"`
+	EastLng     float64   `json:"east_lng"`
+	WestLng     float64   `json:"west_lng"`
+	BaseURL     string    `json:"base_url"`
+	// URL is the storage api url of the image folder of the scene
+	URL string `json:"url"`
+}
+
+func (row sceneRow) scene() scene {
+	return scene{
+		GranuleID:   row.Granule_id,
+		ProductID:   row.Product_id,
+		MgrsTile:    row.Mgrs_tile,
+		SensingTime: row.Sensing_time,
+		CloudCover:  row.Cloud_cover.Float64,
+		NorthLat:    row.North_lat,
+		SouthLat:    row.South_lat,
+		EastLng:     row.East_lon,
+		WestLng:     row.West_lon,
+		BaseURL:     row.Base_url,
+		URL:         formatURL(queryResult{Granule_id: row.Granule_id, Base_url: row.Base_url}),
+	}
+}
+
+// Rect is the bounding rectangle of the footprint of the scene
+func (s scene) Rect() s2.Rect {
+	return s2.RectFromLatLng(s2.LatLngFromDegrees(s.SouthLat, s.WestLng)).
+		AddPoint(s2.LatLngFromDegrees(s.NorthLat, s.EastLng))
+}
+
+// Footprint is the footprint of the scene as a polygon
+func (s scene) Footprint() *s2.Polygon {
+	return rectPolygon(s.Rect())
+}
+
+// BBox is the bounding box of the footprint of the scene, as
+// west, south, east, north like a GeoJSON bbox
+func (s scene) BBox() []float64 {
+	return []float64{s.WestLng, s.SouthLat, s.EastLng, s.NorthLat}
+}
+
+// FootprintGeoJSON is the footprint of the scene as a GeoJSON polygon
+func (s scene) FootprintGeoJSON() geoJSONPolygon {
+	return geoJSONPolygon{
+		Type: "Polygon",
+		Coordinates: [][][2]float64{{
+			{s.WestLng, s.SouthLat},
+			{s.EastLng, s.SouthLat},
+			{s.EastLng, s.NorthLat},
+			{s.WestLng, s.NorthLat},
+			{s.WestLng, s.SouthLat},
+		}},
+	}
+}
+
+// sensedBetween reports whether the scene was sensed between from and to,
+// both inclusive, either of which may be zero for an open range
+func (s scene) sensedBetween(from, to time.Time) bool {
+	return (from.IsZero() || !s.SensingTime.Before(from)) &&
+		(to.IsZero() || !s.SensingTime.After(to))
+}
+
+// sceneFilter narrows a search to the scenes sensed between From and To,
+// both inclusive, either of which may be zero for an open range, and
+// whose cloud cover passes the comparisons of CloudCover
+type sceneFilter struct {
+	From       time.Time
+	To         time.Time
+	CloudCover []comparison
+}
+
+// comparison compares a property of a scene to a value, by one of the
+// operators of comparisonOperators
+type comparison struct {
+	Op    string
+	Value float64
+}
+
+// comparisonOperators are the SQL operators of the operators of a
+// comparison, named like those of the query of a STAC search
+var comparisonOperators = map[string]string{
+	"eq":  "=",
+	"neq": "!=",
+	"lt":  "<",
+	"lte": "<=",
+	"gt":  ">",
+	"gte": ">=",
+}
+
+// holds reports whether the value passes the comparison
+func (c comparison) holds(value float64) bool {
+	switch c.Op {
+	case "eq":
+		return value == c.Value
+	case "neq":
+		return value != c.Value
+	case "lt":
+		return value < c.Value
+	case "lte":
+		return value <= c.Value
+	case "gt":
+		return value > c.Value
+	case "gte":
+		return value >= c.Value
+	}
+	return false
+}
+
+// matches reports whether the scene passes the filter
+func (f sceneFilter) matches(s scene) bool {
+	if !s.sensedBetween(f.From, f.To) {
+		return false
+	}
+	for _, c := range f.CloudCover {
+		if !c.holds(s.CloudCover) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns the scenes passing the filter, for searches of the index
+func (f sceneFilter) apply(scenes []scene) []scene {
+	if f.From.IsZero() && f.To.IsZero() && len(f.CloudCover) == 0 {
+		return scenes
+	}
+	filtered := make([]scene, 0, len(scenes))
+	for _, s := range scenes {
+		if f.matches(s) {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// where returns the conditions of the filter, to be appended to the WHERE
+// clause of a query on the index, along with their parameters
+func (f sceneFilter) where() (string, []bigquery.QueryParameter) {
+	conditions := ""
+	params := make([]bigquery.QueryParameter, 0, 2+len(f.CloudCover))
+	if !f.From.IsZero() {
+		conditions += " AND sensing_time >= @from"
+		params = append(params, bigquery.QueryParameter{Name: "from", Value: f.From})
+	}
+	if !f.To.IsZero() {
+		conditions += " AND sensing_time <= @to"
+		params = append(params, bigquery.QueryParameter{Name: "to", Value: f.To})
+	}
+	for i, c := range f.CloudCover {
+		name := fmt.Sprintf("cloud_cover_%d", i)
+		// a missing cloud cover is read as 0, as by sceneRow
+		conditions += fmt.Sprintf(" AND IFNULL(cloud_cover, 0) %s @%s", comparisonOperators[c.Op], name)
+		params = append(params, bigquery.QueryParameter{Name: name, Value: c.Value})
+	}
+	return conditions, params
+}
+
+// sortNewestFirst sorts the scenes by sensing time, newest first, and
+// then by granule, so pages of them are stable
+func sortNewestFirst(scenes []scene) {
+	sort.Slice(scenes, func(i, j int) bool {
+		if !scenes[i].SensingTime.Equal(scenes[j].SensingTime) {
+			return scenes[i].SensingTime.After(scenes[j].SensingTime)
+		}
+		return scenes[i].GranuleID < scenes[j].GranuleID
+	})
+}
+
+// rectPolygon returns the polygon with the vertices of the rectangle
+func rectPolygon(rect s2.Rect) *s2.Polygon {
+	points := make([]s2.Point, 0, 4)
+	for k := 0; k < 4; k++ {
+		points = append(points, s2.PointFromLatLng(rect.Vertex(k)))
+	}
+	return s2.PolygonFromLoops([]*s2.Loop{s2.LoopFromPoints(points)})
+}
+
+// queryScenes runs the given query, which must select the sceneColumns
+func queryScenes(ctx context.Context, query string, params ...bigquery.QueryParameter) ([]scene, error) {
+	scenes := make([]scene, 0)
+	err := readScenes(ctx, query, func(s scene) bool {
+		scenes = append(scenes, s)
+		return true
+	}, params...)
+	if err != nil {
+		return nil, err
+	}
+	return scenes, nil
+}
+
+// readScenes runs the given query, which must select the sceneColumns,
+// passing the scenes it returns to add until add returns false
+func readScenes(ctx context.Context, query string, add func(scene) bool, params ...bigquery.QueryParameter) error {
+	client, err := bigQueryClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create client: %v", err)
+	}
+
+	q := client.Query(query)
+	q.Parameters = params
+	it, err := q.Read(ctx)
+	if err != nil {
+		return fmt.Errorf("query failed to execute: %v", err)
+	}
+
+	for {
+		var row sceneRow
+		err := it.Next(&row)
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !add(row.scene()) {
+			return nil
+		}
+	}
+}
+
+// sceneUrls returns the urls of the image folders of the scenes
+func sceneUrls(scenes []scene) []string {
+	urls := make([]string, 0, len(scenes))
+	for _, s := range scenes {
+		urls = append(urls, s.URL)
+	}
+	return urls
+}
+
+// rectWhere returns the conditions of the scenes whose footprint intersects
+// the rectangle, which may cross the antimeridian, along with their parameters
+func rectWhere(rect s2.Rect) (string, []bigquery.QueryParameter) {
+	lngCondition := "east_lon >= @west AND west_lon <= @east"
+	if rect.Lng.IsInverted() {
+		lngCondition = "(east_lon >= @west OR west_lon <= @east)"
+	}
+	return "north_lat >= @south AND south_lat <= @north AND " + lngCondition, []bigquery.QueryParameter{
+		{Name: "north", Value: rect.Hi().Lat.Degrees()},
+		{Name: "south", Value: rect.Lo().Lat.Degrees()},
+		{Name: "east", Value: rect.Hi().Lng.Degrees()},
+		{Name: "west", Value: rect.Lo().Lng.Degrees()},
+	}
+}
+
+// getScenesIntersectingRect returns the scenes passing the filter whose
+// footprint intersects the given rectangle, which may cross the antimeridian
+func getScenesIntersectingRect(ctx context.Context, rect s2.Rect, filter sceneFilter) ([]scene, error) {
+	rectConditions, rectParams := rectWhere(rect)
+	conditions, params := filter.where()
+	return queryScenes(ctx, `
+			SELECT `+sceneColumns+`
+			FROM `+"`bigquery-public-data.cloud_storage_geo_index.sentinel_2_index`"+`
+			WHERE `+rectConditions+conditions,
+		append(params, rectParams...)...)
+}
+
+// getScenesInRect returns the distinct scenes passing the filter whose
+// footprint intersects the rectangle, which may cross the antimeridian
+func getScenesInRect(ctx context.Context, rect s2.Rect, filter sceneFilter) ([]scene, error) {
+	if idx := catalog(); idx != nil {
+		return filter.apply(idx.intersectingRect(rect)), nil
+	}
+	candidates, err := getScenesIntersectingRect(ctx, rect, filter)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	scenes := make([]scene, 0, len(candidates))
+	for _, s := range candidates {
+		if !seen[s.GranuleID] {
+			seen[s.GranuleID] = true
+			scenes = append(scenes, s)
+		}
+	}
+	return scenes, nil
+}
+
+// getScenePage returns a page of the scenes passing the filter whose
+// footprint intersects the region, newest first: the limit scenes after
+// the offset newest. The region is a polygon, a rectangle, which may cross
+// the antimeridian, or nil for the whole world.
+func getScenePage(ctx context.Context, region s2.Region, filter sceneFilter, offset, limit int) ([]scene, error) {
+	if idx := catalog(); idx != nil {
+		var candidates []scene
+		switch region := region.(type) {
+		case *s2.Polygon:
+			candidates = idx.intersecting(region)
+		case s2.Rect:
+			candidates = idx.intersectingRect(region)
+		default:
+			candidates = idx.scenes
+		}
+		// copied, as the scenes of the index must keep their order
+		scenes := make([]scene, 0)
+		for _, s := range candidates {
+			if filter.matches(s) {
+				scenes = append(scenes, s)
+			}
+		}
+		sortNewestFirst(scenes)
+		return pageOf(scenes, offset, limit), nil
+	}
+
+	regionConditions := "TRUE"
+	var regionParams []bigquery.QueryParameter
+	polygon, isPolygon := region.(*s2.Polygon)
+	if isPolygon {
+		regionConditions, regionParams = rectWhere(polygon.RectBound())
+	} else if rect, ok := region.(s2.Rect); ok {
+		regionConditions, regionParams = rectWhere(rect)
+	}
+	conditions, params := filter.where()
+	params = append(params, regionParams...)
+	query := `
+			SELECT ` + sceneColumns + `
+			FROM ` + "`bigquery-public-data.cloud_storage_geo_index.sentinel_2_index`" + `
+			WHERE ` + regionConditions + conditions + `
+			ORDER BY sensing_time DESC, granule_id`
+	if !isPolygon {
+		query += `
+			LIMIT @limit OFFSET @offset`
+		params = append(params,
+			bigquery.QueryParameter{Name: "limit", Value: limit},
+			bigquery.QueryParameter{Name: "offset", Value: offset})
+	}
+
+	// which scenes intersect a polygon is only known once they are read, so
+	// the scenes within its bounding rectangle are read, newest first, until
+	// the page is full
+	seen := make(map[string]bool)
+	scenes := make([]scene, 0)
+	err := readScenes(ctx, query, func(s scene) bool {
+		if seen[s.GranuleID] || (isPolygon && !polygon.Intersects(s.Footprint())) {
+			return true
+		}
+		seen[s.GranuleID] = true
+		scenes = append(scenes, s)
+		return !isPolygon || len(scenes) < offset+limit
+	}, params...)
+	if err != nil {
+		return nil, err
+	}
+	if isPolygon {
+		return pageOf(scenes, offset, limit), nil
+	}
+	return scenes, nil
+}
+
+// pageOf returns the limit scenes after the offset first of the scenes
+func pageOf(scenes []scene, offset, limit int) []scene {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(scenes) {
+		offset = len(scenes)
+	}
+	scenes = scenes[offset:]
+	if len(scenes) > limit {
+		scenes = scenes[:limit]
+	}
+	return scenes
+}
+
+// getLatestScenesOfTile returns the n latest scenes of the mgrs tile,
+// newest first
+func getLatestScenesOfTile(ctx context.Context, mgrs string, n int) ([]scene, error) {
+	var scenes []scene
+	if idx := catalog(); idx != nil {
+		scenes = make([]scene, 0)
+		for _, s := range idx.withTilePrefix(mgrs) {
+			if s.MgrsTile == mgrs {
+				scenes = append(scenes, s)
+			}
+		}
+	} else {
+		var err error
+		scenes, err = queryScenes(ctx, `
+				SELECT `+sceneColumns+`
+				FROM `+"`bigquery-public-data.cloud_storage_geo_index.sentinel_2_index`"+`
+				WHERE mgrs_tile = @mgrs
+				ORDER BY sensing_time DESC, granule_id
+				LIMIT @n`,
+			bigquery.QueryParameter{Name: "mgrs", Value: mgrs},
+			bigquery.QueryParameter{Name: "n", Value: n})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sortNewestFirst(scenes)
+	if len(scenes) > n {
+		scenes = scenes[:n]
+	}
+	return scenes, nil
+}
+
+// getScene returns the scene of the granule, or errSceneNotFound
+func getScene(ctx context.Context, granuleID string) (scene, error) {
+	var scenes []scene
+	if idx := catalog(); idx != nil {
+		scenes = idx.withGranule(granuleID)
+	} else {
+		var err error
+		scenes, err = queryScenes(ctx, `
+				SELECT `+sceneColumns+`
+				FROM `+"`bigquery-public-data.cloud_storage_geo_index.sentinel_2_index`"+`
+				WHERE granule_id = @granule
+				LIMIT 1`,
+			bigquery.QueryParameter{Name: "granule", Value: granuleID})
+		if err != nil {
+			return scene{}, err
+		}
+	}
+	if len(scenes) == 0 {
+		return scene{}, errSceneNotFound
+	}
+	return scenes[0], nil
+}
+
+// getScenesOfTile returns the scenes passing the filter of the mgrs tiles
+// starting with the given prefix, e.g. all scenes of the grid zone 32U or
+// of the tile 32UNG
+func getScenesOfTile(ctx context.Context, mgrs string, filter sceneFilter) ([]scene, error) {
+	if idx := catalog(); idx != nil {
+		return filter.apply(idx.withTilePrefix(mgrs)), nil
+	}
+	conditions, params := filter.where()
+	return queryScenes(ctx, `
+			SELECT `+sceneColumns+`
+			FROM `+"`bigquery-public-data.cloud_storage_geo_index.sentinel_2_index`"+`
+			WHERE STARTS_WITH(mgrs_tile, @mgrs)`+conditions,
+		append(params, bigquery.QueryParameter{Name: "mgrs", Value: mgrs})...)
+}
+
+// getScenesWithinArea returns the scenes passing the filter whose footprint
+// is within the bounding box, the scenes of getUrlsBetweenCoords
+func getScenesWithinArea(ctx context.Context, northLat, southLat, eastLng, westLng float64, filter sceneFilter) ([]scene, error) {
+	if idx := catalog(); idx != nil {
+		return filter.apply(idx.within(rectFromArea(northLat, southLat, eastLng, westLng))), nil
+	}
+	conditions, params := filter.where()
+	return queryScenes(ctx, `
+			SELECT `+sceneColumns+`
+			FROM `+"`bigquery-public-data.cloud_storage_geo_index.sentinel_2_index`"+`
+			WHERE north_lat <= @north AND south_lat >= @south
+			AND east_lon <= @east AND west_lon >= @west`+conditions,
+		append(params,
+			bigquery.QueryParameter{Name: "north", Value: northLat},
+			bigquery.QueryParameter{Name: "south", Value: southLat},
+			bigquery.QueryParameter{Name: "east", Value: eastLng},
+			bigquery.QueryParameter{Name: "west", Value: westLng})...)
+}
+
+// getScenesInPolygon returns the distinct scenes passing the filter whose
+// footprint intersects the polygon. Candidates are found by the bounding
+// rectangle of the polygon, and then tested against the polygon itself.
+func getScenesInPolygon(ctx context.Context, polygon *s2.Polygon, filter sceneFilter) ([]scene, error) {
+	if idx := catalog(); idx != nil {
+		return filter.apply(idx.intersecting(polygon)), nil
+	}
+
+	candidates, err := getScenesIntersectingRect(ctx, polygon.RectBound(), filter)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	scenes := make([]scene, 0)
+	for _, s := range candidates {
+		if seen[s.GranuleID] || !polygon.Intersects(s.Footprint()) {
+			continue
+		}
+		seen[s.GranuleID] = true
+		scenes = append(scenes, s)
+	}
+	return scenes, nil
+}
+
+// getScenesAtPoint returns every scene passing the filter whose footprint
+// contains the point, including those of neighbouring tiles overlapping there
+func getScenesAtPoint(ctx context.Context, lat, lng float64, filter sceneFilter) ([]scene, error) {
+	latLng := s2.LatLngFromDegrees(lat, lng)
+
+	var candidates []scene
+	if idx := catalog(); idx != nil {
+		candidates = filter.apply(idx.candidates(s2.CellFromLatLng(latLng)))
+	} else {
+		conditions, params := filter.where()
+		var err error
+		candidates, err = queryScenes(ctx, `
+			SELECT `+sceneColumns+`
+			FROM `+"`bigquery-public-data.cloud_storage_geo_index.sentinel_2_index`"+`
+			WHERE north_lat >= @lat AND south_lat <= @lat
+			AND east_lon >= @lng AND west_lon <= @lng`+conditions,
+			append(params,
+				bigquery.QueryParameter{Name: "lat", Value: lat},
+				bigquery.QueryParameter{Name: "lng", Value: lng})...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	scenes := make([]scene, 0)
+	for _, s := range candidates {
+		// the bounding box, as in the BigQuery index, rather than the
+		// geodesic edges of Footprint, which bulge away from the parallels
+		if s.Rect().ContainsLatLng(latLng) {
+			scenes = append(scenes, s)
+		}
+	}
+	return scenes, nil
+}
+
+// sceneTiles returns the distinct mgrs tiles of the scenes
+func sceneTiles(scenes []scene) []string {
+	seen := make(map[string]bool)
+	tiles := make([]string, 0)
+	for _, s := range scenes {
+		if !seen[s.MgrsTile] {
+			seen[s.MgrsTile] = true
+			tiles = append(tiles, s.MgrsTile)
+		}
+	}
+	return tiles
+}
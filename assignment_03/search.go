@@ -0,0 +1,105 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// the kinds of search
+const (
+	searchPoint = "point"
+	searchArea  = "area"
+	searchPoly  = "poly"
+	searchTile  = "tile"
+)
+
+// mgrsPrefixPattern matches an mgrs grid zone or tile, or a prefix of one
+var mgrsPrefixPattern = regexp.MustCompile(`^[0-9]{1,2}[A-Z]{0,3}$`)
+
+// mgrsTilePattern matches a whole mgrs tile, e.g. 32UNG
+var mgrsTilePattern = regexp.MustCompile(`^[0-9]{1,2}[A-Z]{3}$`)
+
+// search is a search of scenes at a point, within an area, in the polygon
+// of a country or of an mgrs tile, as given by the parameters of /images,
+// /images/area, /poly and the mgrs parameter.
+// Unlike the handlers it is kept around, so it is serializable.
+type search struct {
+	Kind     string  `json:"kind"`
+	Lat      float64 `json:"lat,omitempty"`
+	Lng      float64 `json:"lng,omitempty"`
+	NorthLat float64 `json:"north_lat,omitempty"`
+	SouthLat float64 `json:"south_lat,omitempty"`
+	EastLng  float64 `json:"east_lng,omitempty"`
+	WestLng  float64 `json:"west_lng,omitempty"`
+	Region   string  `json:"region,omitempty"`
+	Country  string  `json:"country,omitempty"`
+	Mgrs     string  `json:"mgrs,omitempty"`
+}
+
+// parseSearch reads the search of a request: a tile search if it has an
+// mgrs parameter, a poly search if it has region and country parameters,
+// an area search if it has north_lat and a point search otherwise
+func parseSearch(ctx context.Context, r *http.Request) (search, error) {
+	switch {
+	case r.FormValue("mgrs") != "":
+		s := search{Kind: searchTile, Mgrs: strings.ToUpper(r.FormValue("mgrs"))}
+		if !mgrsPrefixPattern.MatchString(s.Mgrs) {
+			return s, fmt.Errorf("bad mgrs tile %q", s.Mgrs)
+		}
+		return s, nil
+	case r.FormValue("region") != "" || r.FormValue("country") != "":
+		s := search{Kind: searchPoly, Region: r.FormValue("region"), Country: r.FormValue("country")}
+		return s, validatePolyName(s.Region, s.Country)
+	case r.FormValue("north_lat") != "":
+		northLat, southLat, eastLng, westLng, err := parseArea(r)
+		return search{Kind: searchArea, NorthLat: northLat, SouthLat: southLat, EastLng: eastLng, WestLng: westLng}, err
+	default:
+		lat, lng, err := parsePoint(ctx, r)
+		return search{Kind: searchPoint, Lat: lat, Lng: lng}, err
+	}
+}
+
+// String describes the search as its parameters
+func (s search) String() string {
+	switch s.Kind {
+	case searchPoint:
+		return fmt.Sprintf("lat=%f&lng=%f", s.Lat, s.Lng)
+	case searchArea:
+		return fmt.Sprintf("north_lat=%f&south_lat=%f&east_lng=%f&west_lng=%f", s.NorthLat, s.SouthLat, s.EastLng, s.WestLng)
+	case searchTile:
+		return fmt.Sprintf("mgrs=%s", s.Mgrs)
+	default:
+		return fmt.Sprintf("region=%s&country=%s", s.Region, s.Country)
+	}
+}
+
+// scenes runs the search for the scenes passing the filter, returning the
+// status to respond with if it fails
+func (s search) scenes(ctx context.Context, filter sceneFilter) ([]scene, int, error) {
+	var scenes []scene
+	var err error
+	switch s.Kind {
+	case searchPoint:
+		scenes, err = getScenesAtPoint(ctx, s.Lat, s.Lng, filter)
+	case searchArea:
+		scenes, err = getScenesWithinArea(ctx, s.NorthLat, s.SouthLat, s.EastLng, s.WestLng, filter)
+	case searchPoly:
+		polygons, status, loadErr := loadPolygon(ctx, s.Region, s.Country)
+		if loadErr != nil {
+			return nil, status, fmt.Errorf("%s/%s: %v", s.Region, s.Country, loadErr)
+		}
+		scenes, err = getScenesInPolygon(ctx, PolygonFromPoints(polygons), filter)
+	case searchTile:
+		scenes, err = getScenesOfTile(ctx, s.Mgrs, filter)
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("unknown search %q", s.Kind)
+	}
+	if err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("search failed: %v", err)
+	}
+	return scenes, http.StatusOK, nil
+}
@@ -0,0 +1,494 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/geo/s2"
+	"golang.org/x/net/context"
+)
+
+const (
+	stacVersion      = "1.0.0"
+	stacCollectionID = "sentinel-2-l1c"
+	stacEOExtension  = "https://stac-extensions.github.io/eo/v1.0.0/schema.json"
+	// stacDefaultLimit and stacMaxLimit are the default and largest number
+	// of items of a page of search results
+	stacDefaultLimit = 10
+	stacMaxLimit     = 100
+	// stacMaxOffset is the number of items which can be paged past, which
+	// a search of the whole world reads from the index before its page
+	stacMaxOffset = 10000
+)
+
+// stacConformance are the conformance classes of the STAC API
+var stacConformance = []string{
+	"https://api.stacspec.org/v1.0.0/core",
+	"https://api.stacspec.org/v1.0.0/collections",
+	"https://api.stacspec.org/v1.0.0/item-search",
+	"https://api.stacspec.org/v1.0.0-rc.1/item-search#query",
+}
+
+// stacBand is a band of the eo extension
+type stacBand struct {
+	Name       string `json:"name"`
+	CommonName string `json:"common_name,omitempty"`
+	// CenterWavelength is in micrometers
+	CenterWavelength float64 `json:"center_wavelength"`
+}
+
+// stacBands are the bands of the Sentinel 2 MSI, by the suffix of their files
+var stacBands = map[string]stacBand{
+	"B01": {"B01", "coastal", 0.443},
+	"B02": {"B02", "blue", 0.49},
+	"B03": {"B03", "green", 0.56},
+	"B04": {"B04", "red", 0.665},
+	"B05": {"B05", "rededge", 0.705},
+	"B06": {"B06", "rededge", 0.74},
+	"B07": {"B07", "rededge", 0.783},
+	"B08": {"B08", "nir", 0.842},
+	"B8A": {"B8A", "nir08", 0.865},
+	"B09": {"B09", "nir09", 0.945},
+	"B10": {"B10", "cirrus", 1.375},
+	"B11": {"B11", "swir16", 1.61},
+	"B12": {"B12", "swir22", 2.19},
+}
+
+type stacLink struct {
+	Rel    string `json:"rel"`
+	Type   string `json:"type,omitempty"`
+	Href   string `json:"href"`
+	Method string `json:"method,omitempty"`
+	// Body and Merge describe the body of a POST link, merged into the
+	// body of the current request if Merge is set
+	Body  map[string]interface{} `json:"body,omitempty"`
+	Merge bool                   `json:"merge,omitempty"`
+}
+
+type stacCatalog struct {
+	Type        string     `json:"type"`
+	STACVersion string     `json:"stac_version"`
+	ID          string     `json:"id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	ConformsTo  []string   `json:"conformsTo"`
+	Links       []stacLink `json:"links"`
+}
+
+type stacCollection struct {
+	Type           string                 `json:"type"`
+	STACVersion    string                 `json:"stac_version"`
+	STACExtensions []string               `json:"stac_extensions"`
+	ID             string                 `json:"id"`
+	Title          string                 `json:"title"`
+	Description    string                 `json:"description"`
+	License        string                 `json:"license"`
+	Extent         stacExtent             `json:"extent"`
+	Summaries      map[string]interface{} `json:"summaries"`
+	Links          []stacLink             `json:"links"`
+}
+
+type stacExtent struct {
+	Spatial struct {
+		BBox [][]float64 `json:"bbox"`
+	} `json:"spatial"`
+	Temporal struct {
+		// Interval are start and end times, nil if open
+		Interval [][]*time.Time `json:"interval"`
+	} `json:"temporal"`
+}
+
+type stacAsset struct {
+	Href  string     `json:"href"`
+	Type  string     `json:"type"`
+	Title string     `json:"title,omitempty"`
+	Roles []string   `json:"roles"`
+	Bands []stacBand `json:"eo:bands,omitempty"`
+}
+
+type stacItem struct {
+	Type           string                 `json:"type"`
+	STACVersion    string                 `json:"stac_version"`
+	STACExtensions []string               `json:"stac_extensions"`
+	ID             string                 `json:"id"`
+	Collection     string                 `json:"collection"`
+	Geometry       geoJSONPolygon         `json:"geometry"`
+	BBox           []float64              `json:"bbox"`
+	Properties     map[string]interface{} `json:"properties"`
+	Assets         map[string]stacAsset   `json:"assets"`
+	Links          []stacLink             `json:"links"`
+}
+
+// stacItemCollection is a page of search results. Their number is not
+// known, as only the scenes of the page are read from the index.
+type stacItemCollection struct {
+	Type           string     `json:"type"`
+	Features       []stacItem `json:"features"`
+	NumberReturned int        `json:"numberReturned"`
+	Links          []stacLink `json:"links"`
+}
+
+// stacSearch is a STAC item search, given either as the json body of a
+// POST or as the parameters of a GET, where bbox is comma separated and
+// intersects and query are json
+type stacSearch struct {
+	BBox       []float64       `json:"bbox"`
+	Intersects json.RawMessage `json:"intersects"`
+	// Datetime is a time or an interval of two times separated by a
+	// slash, either of which may be open as ".." or empty
+	Datetime string `json:"datetime"`
+	// Query holds comparisons (eq, neq, lt, lte, gt, gte) of properties
+	// to values, of which only eo:cloud_cover is supported
+	Query map[string]map[string]float64 `json:"query"`
+	Limit int                           `json:"limit"`
+	// Page is the page of the results, starting at 1
+	Page int `json:"page"`
+}
+
+// parseSTACSearch reads the search of a GET or POST request to /stac/search,
+// the body of which must be limited by the caller
+func parseSTACSearch(r *http.Request) (stacSearch, error) {
+	var q stacSearch
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			return q, fmt.Errorf("bad search: %v", err)
+		}
+		return q, nil
+	}
+
+	var err error
+	if q.BBox, err = parseBBox(r.FormValue("bbox")); err != nil {
+		return q, err
+	}
+	if intersects := r.FormValue("intersects"); intersects != "" {
+		q.Intersects = json.RawMessage(intersects)
+	}
+	q.Datetime = r.FormValue("datetime")
+	if query := r.FormValue("query"); query != "" {
+		if err := json.Unmarshal([]byte(query), &q.Query); err != nil {
+			return q, fmt.Errorf("bad parameter query: %v", err)
+		}
+	}
+	for name, dst := range map[string]*int{"limit": &q.Limit, "page": &q.Page} {
+		value := r.FormValue(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return q, fmt.Errorf("bad parameter %s: %q", name, value)
+		}
+		*dst = n
+	}
+	return q, nil
+}
+
+// validate checks the search, filling in the defaults of limit and page
+func (q *stacSearch) validate() error {
+	if len(q.BBox) > 0 && len(q.Intersects) > 0 {
+		return fmt.Errorf("bbox and intersects cannot both be given")
+	}
+	if len(q.BBox) > 0 {
+		if _, err := bboxRect(q.BBox); err != nil {
+			return err
+		}
+	}
+	for property, comparisons := range q.Query {
+		if property != "eo:cloud_cover" {
+			return fmt.Errorf("bad query of %q, only eo:cloud_cover can be queried", property)
+		}
+		for op := range comparisons {
+			if _, ok := comparisonOperators[op]; !ok {
+				return fmt.Errorf("bad query operator %q", op)
+			}
+		}
+	}
+	if q.Limit == 0 {
+		q.Limit = stacDefaultLimit
+	}
+	if q.Limit < 0 {
+		return fmt.Errorf("bad limit %d", q.Limit)
+	}
+	if q.Limit > stacMaxLimit {
+		q.Limit = stacMaxLimit
+	}
+	if q.Page == 0 {
+		q.Page = 1
+	}
+	if q.Page < 0 {
+		return fmt.Errorf("bad page %d", q.Page)
+	}
+	// checked before multiplying, as a huge page would overflow the offset
+	if q.Page > stacMaxOffset/q.Limit+1 || q.offset() > stacMaxOffset {
+		return fmt.Errorf("bad page %d, only the first %d items can be paged through", q.Page, stacMaxOffset)
+	}
+	return nil
+}
+
+// offset is the number of items before the page of the search
+func (q stacSearch) offset() int {
+	return (q.Page - 1) * q.Limit
+}
+
+// scenes returns the scenes of the page of the search, newest first, and
+// the scene after them if there is one, along with the status to respond
+// with if the search fails
+func (q stacSearch) scenes(ctx context.Context) ([]scene, int, error) {
+	from, to, err := parseInterval(q.Datetime)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	filter := sceneFilter{From: from, To: to}
+	for _, comparisons := range q.Query {
+		for op, value := range comparisons {
+			filter.CloudCover = append(filter.CloudCover, comparison{Op: op, Value: value})
+		}
+	}
+
+	var region s2.Region
+	if len(q.Intersects) > 0 {
+		area, err := ParseGeoJSON(bytes.NewReader(q.Intersects))
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("bad intersects: %v", err)
+		}
+		region = PolygonFromPoints(area)
+	} else if len(q.BBox) > 0 {
+		region, _ = bboxRect(q.BBox)
+	}
+	// one more than the page, to tell whether there is a next page
+	scenes, err := getScenePage(ctx, region, filter, q.offset(), q.Limit+1)
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	return scenes, http.StatusOK, nil
+}
+
+// stacItemOf returns the STAC item of the scene, with an asset for each of
+// the image files of its folder
+func stacItemOf(base string, s scene, images []string) stacItem {
+	platform := ""
+	if strings.HasPrefix(s.ProductID, "S2A") || strings.HasPrefix(s.ProductID, "S2B") {
+		platform = "sentinel-" + strings.ToLower(s.ProductID[1:3])
+	}
+	item := stacItem{
+		Type:           "Feature",
+		STACVersion:    stacVersion,
+		STACExtensions: []string{stacEOExtension},
+		ID:             s.GranuleID,
+		Collection:     stacCollectionID,
+		Geometry:       s.FootprintGeoJSON(),
+		BBox:           s.BBox(),
+		Properties: map[string]interface{}{
+			"datetime":       s.SensingTime.UTC(),
+			"eo:cloud_cover": s.CloudCover,
+			"constellation":  "sentinel-2",
+			"instruments":    []string{"msi"},
+			"s2:product_id":  s.ProductID,
+			"s2:mgrs_tile":   s.MgrsTile,
+		},
+		Assets: make(map[string]stacAsset),
+		Links: []stacLink{
+			{Rel: "collection", Type: "application/json", Href: base + "/stac/collections/" + stacCollectionID},
+			{Rel: "parent", Type: "application/json", Href: base + "/stac/collections/" + stacCollectionID},
+			{Rel: "root", Type: "application/json", Href: base + "/stac"},
+		},
+	}
+	if platform != "" {
+		item.Properties["platform"] = platform
+	}
+	for _, image := range images {
+		object, err := objectFromMediaLink(image)
+		if err != nil {
+			continue
+		}
+		name := strings.TrimSuffix(path.Base(object), path.Ext(object))
+		key := name[strings.LastIndex(name, "_")+1:]
+		asset := stacAsset{Href: image, Type: "image/jp2", Title: key, Roles: []string{"data"}}
+		if band, ok := stacBands[key]; ok {
+			asset.Bands = []stacBand{band}
+		} else if key == "TCI" {
+			asset.Title = "True color image"
+			asset.Roles = []string{"visual"}
+		}
+		item.Assets[key] = asset
+	}
+	return item
+}
+
+// stacHandler serves the landing page of the STAC API
+func stacHandler(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r)
+	writeJSON(w, http.StatusOK, stacCatalog{
+		Type:        "Catalog",
+		STACVersion: stacVersion,
+		ID:          "sentinel-2-search",
+		Title:       "Sentinel 2 image search",
+		Description: "Search of the Sentinel 2 scenes of the Google Cloud public dataset",
+		ConformsTo:  stacConformance,
+		Links: []stacLink{
+			{Rel: "self", Type: "application/json", Href: base + "/stac"},
+			{Rel: "root", Type: "application/json", Href: base + "/stac"},
+			{Rel: "conformance", Type: "application/json", Href: base + "/stac/conformance"},
+			{Rel: "service-desc", Type: openAPIType, Href: base + "/stac/api"},
+			{Rel: "data", Type: "application/json", Href: base + "/stac/collections"},
+			{Rel: "child", Type: "application/json", Href: base + "/stac/collections/" + stacCollectionID},
+			{Rel: "search", Type: "application/geo+json", Href: base + "/stac/search", Method: http.MethodGet},
+			{Rel: "search", Type: "application/geo+json", Href: base + "/stac/search", Method: http.MethodPost},
+		},
+	})
+}
+
+// stacCollectionOf describes the single collection of the STAC API
+func stacCollectionOf(base string) stacCollection {
+	bands := make([]stacBand, 0, len(stacBands))
+	for _, band := range stacBands {
+		bands = append(bands, band)
+	}
+	sort.Slice(bands, func(i, j int) bool { return bands[i].CenterWavelength < bands[j].CenterWavelength })
+
+	// the first Sentinel 2 scenes were sensed on the launch of Sentinel 2A
+	start := time.Date(2015, 6, 23, 0, 0, 0, 0, time.UTC)
+	c := stacCollection{
+		Type:           "Collection",
+		STACVersion:    stacVersion,
+		STACExtensions: []string{stacEOExtension},
+		ID:             stacCollectionID,
+		Title:          "Sentinel 2 Level-1C",
+		Description:    "Top of atmosphere reflectances of the Sentinel 2 MSI, in tiles of the MGRS grid",
+		License:        "proprietary",
+		Summaries: map[string]interface{}{
+			"constellation": []string{"sentinel-2"},
+			"platform":      []string{"sentinel-2a", "sentinel-2b"},
+			"instruments":   []string{"msi"},
+			"eo:bands":      bands,
+		},
+		Links: []stacLink{
+			{Rel: "self", Type: "application/json", Href: base + "/stac/collections/" + stacCollectionID},
+			{Rel: "root", Type: "application/json", Href: base + "/stac"},
+			{Rel: "parent", Type: "application/json", Href: base + "/stac"},
+			{Rel: "license", Type: "application/pdf", Href: "https://sentinel.esa.int/documents/247904/690755/Sentinel_Data_Legal_Notice"},
+		},
+	}
+	c.Extent.Spatial.BBox = [][]float64{{-180, -90, 180, 90}}
+	c.Extent.Temporal.Interval = [][]*time.Time{{&start, nil}}
+	return c
+}
+
+func stacConformanceHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string][]string{"conformsTo": stacConformance})
+}
+
+func stacCollectionsHandler(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"links": []stacLink{
+			{Rel: "self", Type: "application/json", Href: base + "/stac/collections"},
+			{Rel: "root", Type: "application/json", Href: base + "/stac"},
+			{Rel: "parent", Type: "application/json", Href: base + "/stac"},
+		},
+		"collections": []stacCollection{stacCollectionOf(base)},
+	})
+}
+
+func stacCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, stacCollectionOf(baseURL(r)))
+}
+
+// stacAPIHandler serves the OpenAPI description of the STAC API
+func stacAPIHandler(w http.ResponseWriter, r *http.Request) {
+	doc := newOpenAPIDocument("Sentinel 2 image search", baseURL(r)+"/stac")
+	searchParams := []openAPIParameter{
+		openAPIQuery("bbox", "string", "west,south,east,north in degrees"),
+		openAPIQuery("intersects", "string", "a GeoJSON geometry"),
+		openAPIQuery("datetime", "string", "a time or an interval of two times separated by a slash, either of which may be open as .."),
+		openAPIQuery("query", "string", `comparisons of eo:cloud_cover, e.g. {"eo:cloud_cover":{"lt":20}}`),
+		openAPIQuery("limit", "integer", fmt.Sprintf("the number of items of a page, at most %d", stacMaxLimit)),
+		openAPIQuery("page", "integer", "the page of the items, starting at 1"),
+	}
+	post := openAPIGet("Search the scenes", "application/geo+json")
+	post.RequestBody = &openAPIBody{Required: true, Content: map[string]struct{}{"application/json": {}}}
+	doc.Paths["/"] = map[string]openAPIOperation{"get": openAPIGet("The landing page", "application/json")}
+	doc.Paths["/api"] = map[string]openAPIOperation{"get": openAPIGet("This description", openAPIType)}
+	doc.Paths["/conformance"] = map[string]openAPIOperation{"get": openAPIGet("The conformance classes", "application/json")}
+	doc.Paths["/collections"] = map[string]openAPIOperation{"get": openAPIGet("The collections", "application/json")}
+	doc.Paths["/collections/"+stacCollectionID] = map[string]openAPIOperation{"get": openAPIGet("The collection of the scenes", "application/json")}
+	doc.Paths["/search"] = map[string]openAPIOperation{
+		"get":  openAPIGet("Search the scenes", "application/geo+json", searchParams...),
+		"post": post,
+	}
+	writeJSONAs(w, http.StatusOK, openAPIType, doc)
+}
+
+// stacSearchHandler searches the scenes as STAC items, a page at a time
+func stacSearchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(newContext(r), config.Timeout)
+	defer cancel()
+
+	// the body is mostly the intersects polygon
+	r.Body = http.MaxBytesReader(w, r.Body, maxPolygonSize)
+	q, err := parseSTACSearch(r)
+	if err == nil {
+		err = q.validate()
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	scenes, status, err := q.scenes(ctx)
+	if status == http.StatusBadGateway {
+		searchFailed(ctx, w, err)
+		return
+	}
+	if err != nil {
+		writeError(w, status, "%v", err)
+		return
+	}
+
+	page := scenes
+	if len(page) > q.Limit {
+		page = page[:q.Limit]
+	}
+
+	images := make(map[string][]string)
+	getImageUrlsWithProgress(ctx, sceneUrls(page), func(directory string, urls []string) {
+		images[directory] = urls
+	})
+	base := baseURL(r)
+	items := make([]stacItem, 0, len(page))
+	for _, s := range page {
+		items = append(items, stacItemOf(base, s, images[s.URL]))
+	}
+
+	response := stacItemCollection{
+		Type:           "FeatureCollection",
+		Features:       items,
+		NumberReturned: len(items),
+		Links:          []stacLink{{Rel: "root", Type: "application/json", Href: base + "/stac"}},
+	}
+	// clients follow the next links, so none leads past the largest offset
+	if len(scenes) > q.Limit && q.offset()+q.Limit <= stacMaxOffset {
+		next := stacLink{Rel: "next", Type: "application/geo+json", Href: base + "/stac/search"}
+		if r.Method == http.MethodPost {
+			next.Method = http.MethodPost
+			next.Body = map[string]interface{}{"page": q.Page + 1}
+			next.Merge = true
+		} else {
+			params := url.Values{}
+			for name, values := range r.URL.Query() {
+				params[name] = values
+			}
+			params.Set("page", strconv.Itoa(q.Page+1))
+			next.Href += "?" + params.Encode()
+		}
+		response.Links = append(response.Links, next)
+	}
+	writeJSONAs(w, http.StatusOK, "application/geo+json", response)
+}
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSTACSearchPage(t *testing.T) {
+	sensed := time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC)
+	scenes := make([]scene, 0, 3)
+	for _, id := range []string{"a", "b", "c"} {
+		scenes = append(scenes, scene{GranuleID: id, SensingTime: sensed, SouthLat: 55, NorthLat: 56, WestLng: 9, EastLng: 10})
+		sensed = sensed.Add(time.Hour)
+	}
+	setCatalog(newSceneIndex(scenes))
+	defer setCatalog(nil)
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"limit=2", http.StatusOK},
+		{"limit=2&page=2", http.StatusOK},
+		{"limit=2&page=50", http.StatusOK},
+		{"limit=100&page=101", http.StatusOK},
+		{"limit=100&page=102", http.StatusBadRequest},
+		// overflows the offset if multiplied by the limit unchecked
+		{"limit=100&page=138350580552821638", http.StatusBadRequest},
+		{"page=-1", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		stacSearchHandler(w, httptest.NewRequest(http.MethodGet, "/stac/search?"+test.query, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d: %s", test.query, w.Code, test.status, w.Body)
+		}
+	}
+}
+
+func TestPageOf(t *testing.T) {
+	scenes := []scene{{GranuleID: "a"}, {GranuleID: "b"}, {GranuleID: "c"}}
+	tests := []struct {
+		offset, limit int
+		want          int
+	}{
+		{0, 2, 2},
+		{2, 2, 1},
+		{5, 2, 0},
+		{-4611686018427387916, 2, 2},
+	}
+	for _, test := range tests {
+		if got := pageOf(scenes, test.offset, test.limit); len(got) != test.want {
+			t.Errorf("pageOf(%d, %d): got %d scenes, want %d", test.offset, test.limit, len(got), test.want)
+		}
+	}
+}
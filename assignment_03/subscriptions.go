@@ -0,0 +1,455 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+// maxFeedEntries is the number of new scenes kept in the feed of a subscription
+const maxFeedEntries = 1000
+
+// subscriptionLookback is how long before its last run a subscription
+// searches for new scenes again, as scenes are added to the index some
+// time after they are sensed
+const subscriptionLookback = 7 * 24 * time.Hour
+
+// Subscription is a saved search, re-run periodically to find the scenes
+// appearing in the index since it was last run
+type Subscription struct {
+	ID     string `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Search search `json:"search"`
+	// only scenes with at most MaxCloudCover percent of clouds, sensed
+	// between From and To (if set), are looked for
+	MaxCloudCover float64   `json:"max_cloud_cover"`
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	Created       time.Time `json:"created"`
+	LastRun       time.Time `json:"last_run"`
+	LastError     string    `json:"last_error,omitempty"`
+
+	// watermark is the start of the last successful run. Scenes sensed
+	// subscriptionLookback before it are taken to be in the index by then,
+	// so later runs only search for the scenes sensed after.
+	watermark time.Time
+	// seen are the granules found by the runs so far along with their
+	// sensing time, nil until the first run, which records the granules
+	// present without reporting them as new. Granules sensed before the
+	// scenes searched for by the next run are forgotten.
+	seen map[string]time.Time
+	// entries are the new scenes found by the runs, newest first
+	entries []feedEntry
+}
+
+// feedEntry is a scene found new by a run of a subscription
+type feedEntry struct {
+	Found time.Time `json:"found"`
+	Scene scene     `json:"scene"`
+}
+
+// feedResponse is the body returned by the feed of a subscription
+type feedResponse struct {
+	ID      string      `json:"id"`
+	Name    string      `json:"name,omitempty"`
+	LastRun time.Time   `json:"last_run"`
+	Count   int         `json:"count"`
+	Entries []feedEntry `json:"entries"`
+}
+
+// subscriptionFile is the representation of a Subscription on disk
+type subscriptionFile struct {
+	Subscription
+	Watermark time.Time            `json:"watermark"`
+	Seen      map[string]time.Time `json:"seen"`
+	Entries   []feedEntry          `json:"entries"`
+}
+
+var errSubscriptionNotFound = errors.New("subscription not found")
+
+// matches reports whether the scene passes the filters of the subscription
+func (sub *Subscription) matches(s scene) bool {
+	return s.CloudCover <= sub.MaxCloudCover && s.sensedBetween(sub.From, sub.To)
+}
+
+// window returns the filter of the scenes searched for by the next run: those
+// sensed between From and To, but no earlier than subscriptionLookback
+// before the watermark
+func (sub *Subscription) window() sceneFilter {
+	filter := sceneFilter{From: sub.From, To: sub.To}
+	if !sub.watermark.IsZero() {
+		if since := sub.watermark.Add(-subscriptionLookback); since.After(filter.From) {
+			filter.From = since
+		}
+	}
+	return filter
+}
+
+// subscriptionRegistry holds the subscriptions of the app, keeping each in
+// a json file of its own if it has a directory
+type subscriptionRegistry struct {
+	dir string
+
+	// saving serializes the writes of the files, which are made without
+	// holding mu
+	saving sync.Mutex
+
+	mu   sync.Mutex
+	subs map[string]*Subscription
+}
+
+// subscriptions is the subscriptionRegistry of the app, loaded by Configure
+var subscriptions = &subscriptionRegistry{subs: make(map[string]*Subscription)}
+
+// loadSubscriptions reads the subscriptions kept in the directory at path,
+// creating it if it does not exist yet
+func loadSubscriptions(path string) (*subscriptionRegistry, error) {
+	reg := &subscriptionRegistry{dir: path, subs: make(map[string]*Subscription)}
+	if path == "" {
+		return reg, nil
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(path, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var f subscriptionFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		sub := f.Subscription
+		sub.watermark = f.Watermark
+		sub.seen = f.Seen
+		sub.entries = f.Entries
+		reg.subs[sub.ID] = &sub
+	}
+	return reg, nil
+}
+
+// path returns the file the subscription of the id is kept in
+func (reg *subscriptionRegistry) path(id string) string {
+	return filepath.Join(reg.dir, id+".json")
+}
+
+// save writes the subscription of the id to its file, if the registry has
+// a directory, or removes the file if the subscription was removed. It
+// must be called without mu held, after the change to save.
+func (reg *subscriptionRegistry) save(id string) error {
+	if reg.dir == "" {
+		return nil
+	}
+	reg.saving.Lock()
+	defer reg.saving.Unlock()
+
+	// the subscription is read after waiting for the previous writes, so
+	// the last write always saves the latest changes
+	reg.mu.Lock()
+	sub, ok := reg.subs[id]
+	var f subscriptionFile
+	if ok {
+		f = subscriptionFile{Subscription: *sub, Watermark: sub.watermark, Entries: sub.entries}
+		if sub.seen != nil {
+			f.Seen = make(map[string]time.Time, len(sub.seen))
+			for granule, sensed := range sub.seen {
+				f.Seen[granule] = sensed
+			}
+		}
+	}
+	reg.mu.Unlock()
+
+	if !ok {
+		if err := os.Remove(reg.path(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	// written next to the file and renamed over it, so a crash
+	// never leaves a partially written file
+	tmp := reg.path(id) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, reg.path(id))
+}
+
+// list returns the subscriptions, oldest first. It must be called with mu held.
+func (reg *subscriptionRegistry) list() []*Subscription {
+	subs := make([]*Subscription, 0, len(reg.subs))
+	for _, sub := range reg.subs {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Created.Before(subs[j].Created) })
+	return subs
+}
+
+// add registers the subscription, giving it an id
+func (reg *subscriptionRegistry) add(sub *Subscription) error {
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	sub.ID = id
+	sub.Created = time.Now().UTC()
+
+	reg.mu.Lock()
+	reg.subs[sub.ID] = sub
+	reg.mu.Unlock()
+	return reg.save(sub.ID)
+}
+
+// get returns a copy of the subscription of the id, along with its feed
+func (reg *subscriptionRegistry) get(id string) (Subscription, []feedEntry, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	sub, ok := reg.subs[id]
+	if !ok {
+		return Subscription{}, nil, errSubscriptionNotFound
+	}
+	return *sub, sub.entries, nil
+}
+
+// all returns copies of all subscriptions, oldest first
+func (reg *subscriptionRegistry) all() []Subscription {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	subs := make([]Subscription, 0, len(reg.subs))
+	for _, sub := range reg.list() {
+		subs = append(subs, *sub)
+	}
+	return subs
+}
+
+// remove deletes the subscription of the id
+func (reg *subscriptionRegistry) remove(id string) error {
+	reg.mu.Lock()
+	if _, ok := reg.subs[id]; !ok {
+		reg.mu.Unlock()
+		return errSubscriptionNotFound
+	}
+	delete(reg.subs, id)
+	reg.mu.Unlock()
+	return reg.save(id)
+}
+
+// run re-runs the search of the subscription of the id for the scenes of
+// its window, adding the matching scenes not seen before to its feed
+func (reg *subscriptionRegistry) run(ctx context.Context, id string) error {
+	query, _, err := reg.get(id)
+	if err != nil {
+		return err
+	}
+	start := time.Now().UTC()
+	window := query.window()
+	var found []scene
+	var searchErr error
+	// nothing is left to search once the window has passed To
+	if window.To.IsZero() || !window.From.After(window.To) {
+		found, _, searchErr = query.Search.scenes(ctx, window)
+	}
+
+	reg.record(ctx, id, start, found, searchErr)
+	if err := reg.save(id); err != nil {
+		return err
+	}
+	return searchErr
+}
+
+// record records the result of a run of the subscription of the id which
+// started at start
+func (reg *subscriptionRegistry) record(ctx context.Context, id string, start time.Time, found []scene, searchErr error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	sub, ok := reg.subs[id]
+	if !ok {
+		// removed while running
+		return
+	}
+	now := time.Now().UTC()
+	sub.LastRun = now
+	if searchErr != nil {
+		sub.LastError = searchErr.Error()
+		return
+	}
+	sub.LastError = ""
+
+	baseline := sub.seen == nil
+	if baseline {
+		sub.seen = make(map[string]time.Time)
+	}
+	entries := make([]feedEntry, 0)
+	for _, s := range found {
+		if _, ok := sub.seen[s.GranuleID]; ok || !sub.matches(s) {
+			continue
+		}
+		sub.seen[s.GranuleID] = s.SensingTime
+		if !baseline {
+			entries = append(entries, feedEntry{Found: now, Scene: s})
+		}
+	}
+
+	// the next run searches no further back than the new window, so the
+	// granules sensed before it are never found again
+	sub.watermark = start
+	since := sub.window().From
+	for granule, sensed := range sub.seen {
+		if sensed.Before(since) {
+			delete(sub.seen, granule)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Scene.SensingTime.After(entries[j].Scene.SensingTime) })
+	sub.entries = append(entries, sub.entries...)
+	if len(sub.entries) > maxFeedEntries {
+		sub.entries = sub.entries[:maxFeedEntries]
+	}
+	if len(entries) > 0 {
+		logger.Infof(ctx, "Subscription %s found %d new scenes", sub.ID, len(entries))
+	}
+}
+
+// runAll re-runs every subscription
+func (reg *subscriptionRegistry) runAll(ctx context.Context) {
+	for _, sub := range reg.all() {
+		runCtx, cancel := context.WithTimeout(ctx, config.Timeout)
+		if err := reg.run(runCtx, sub.ID); err != nil {
+			logger.Errorf(ctx, "Subscription %s failed: %v", sub.ID, err)
+		}
+		cancel()
+	}
+}
+
+// getSubscription returns the subscription of the request along with its
+// feed, writing the error response if there is none
+func getSubscription(w http.ResponseWriter, r *http.Request) (Subscription, []feedEntry, bool) {
+	id := mux.Vars(r)["id"]
+	sub, entries, err := subscriptions.get(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s: %v", id, err)
+		return sub, nil, false
+	}
+	return sub, entries, true
+}
+
+// createSubscriptionHandlerV1 saves the search of the parameters of
+// parseSearch, filtered by the max_cloud_cover percentage and the from
+// and to dates, and runs it for the first time
+func createSubscriptionHandlerV1(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(newContext(r), config.Timeout)
+	defer cancel()
+	if err := subscriptionsSupported(); err != nil {
+		writeError(w, http.StatusNotImplemented, "%v", err)
+		return
+	}
+
+	s, err := parseSearch(ctx, r)
+	if err != nil {
+		writeError(w, paramStatus(err), "%v", err)
+		return
+	}
+	sub := &Subscription{Name: r.FormValue("name"), Search: s, MaxCloudCover: 100}
+	if r.FormValue("max_cloud_cover") != "" {
+		sub.MaxCloudCover, err = parseFloatParam(r, "max_cloud_cover")
+		if err == nil && (sub.MaxCloudCover < 0 || sub.MaxCloudCover > 100) {
+			err = fmt.Errorf("bad parameter max_cloud_cover: %v, expected a percentage", sub.MaxCloudCover)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+	if sub.From, err = parseTime(r, "from", false); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if sub.To, err = parseTime(r, "to", true); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	if err := subscriptions.add(sub); err != nil {
+		logger.Errorf(ctx, "Failed to save subscription: %v", err)
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	// a failing first run is recorded in the subscription, and retried
+	// with the next run
+	if err := subscriptions.run(ctx, sub.ID); err != nil {
+		logger.Errorf(ctx, "First run of subscription %s failed: %v", sub.ID, err)
+	}
+	created, _, err := subscriptions.get(sub.ID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s: %v", sub.ID, err)
+		return
+	}
+	w.Header().Set("Location", "/v1/subscriptions/"+sub.ID)
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// subscriptionsHandlerV1 lists all subscriptions
+func subscriptionsHandlerV1(w http.ResponseWriter, r *http.Request) {
+	subs := subscriptions.all()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"count": len(subs), "subscriptions": subs})
+}
+
+func subscriptionHandlerV1(w http.ResponseWriter, r *http.Request) {
+	if sub, _, ok := getSubscription(w, r); ok {
+		writeJSON(w, http.StatusOK, sub)
+	}
+}
+
+func deleteSubscriptionHandlerV1(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	err := subscriptions.remove(id)
+	if err == errSubscriptionNotFound {
+		writeError(w, http.StatusNotFound, "%s: %v", id, err)
+		return
+	}
+	if err != nil {
+		logger.Errorf(newContext(r), "Failed to delete subscription %s: %v", id, err)
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// subscriptionFeedHandlerV1 returns the new scenes found by a subscription,
+// newest first, optionally only those found after the since parameter
+func subscriptionFeedHandlerV1(w http.ResponseWriter, r *http.Request) {
+	sub, entries, ok := getSubscription(w, r)
+	if !ok {
+		return
+	}
+	since, err := parseTime(r, "since", false)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	feed := make([]feedEntry, 0, len(entries))
+	for _, e := range entries {
+		if e.Found.After(since) {
+			feed = append(feed, e)
+		}
+	}
+	writeJSON(w, http.StatusOK, feedResponse{ID: sub.ID, Name: sub.Name, LastRun: sub.LastRun, Count: len(feed), Entries: feed})
+}
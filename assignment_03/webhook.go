@@ -0,0 +1,239 @@
+package app
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// the states of the callback of a job
+const (
+	callbackPending   = "pending"
+	callbackDelivered = "delivered"
+	callbackFailed    = "failed"
+)
+
+// callbacks are retried with exponential backoff, waiting callbackBackoff
+// before the second attempt and twice as long before each following one.
+// An attempt fails unless the receiver responds within callbackTimeout.
+var (
+	callbackAttempts = 6
+	callbackBackoff  = time.Second
+	callbackTimeout  = 30 * time.Second
+)
+
+// callbackPayload is the body posted to the callback url of a finished job
+type callbackPayload struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	State  string `json:"state"`
+	Error  string `json:"error,omitempty"`
+	Search search `json:"search"`
+	// Count is the number of images or files of the result
+	Count    int       `json:"count"`
+	Created  time.Time `json:"created"`
+	Finished time.Time `json:"finished"`
+	// URL is the path of the job, where the result is found
+	URL string `json:"url"`
+	// Archive is the path of the archive of a finished export job
+	Archive string `json:"archive,omitempty"`
+}
+
+// nonPublicNetworks are the networks callbacks are not sent to, lest jobs
+// be used to reach the network of the app: unspecified, loopback, private,
+// shared, link local (including the metadata servers of cloud providers),
+// reserved and multicast addresses
+var nonPublicNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/3",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// publicIP reports whether ip is not within any of the nonPublicNetworks
+func publicIP(ip net.IP) bool {
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// callbackHostAllowed reports whether host is one of the CallbackHosts of
+// the config, or a subdomain of one
+func callbackHostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range config.CallbackHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicAddresses returns the addresses of host, failing unless they are
+// all public
+func publicAddresses(ctx context.Context, host string) ([]net.IP, error) {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = lookupIP(ctx, host); err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no addresses found for %s", host)
+		}
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return nil, fmt.Errorf("%s is at the non-public address %s", host, ip)
+		}
+	}
+	return ips, nil
+}
+
+// validateCallback checks the callback url of a job: its host must be one
+// of the CallbackHosts of the config if there are any, or else be at public
+// addresses only
+func validateCallback(ctx context.Context, callback string) error {
+	if callback == "" {
+		return nil
+	}
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("bad callback %q, expected an http or https url", callback)
+	}
+	if config.WebhookSecret == "" {
+		return errors.New("callbacks are disabled, as no webhook secret is configured")
+	}
+	switch {
+	case callbackHostAllowed(u.Hostname()):
+		return nil
+	case len(config.CallbackHosts) > 0:
+		return fmt.Errorf("bad callback %q, callbacks may only be sent to %s",
+			callback, strings.Join(config.CallbackHosts, ", "))
+	}
+	if _, err := publicAddresses(ctx, u.Hostname()); err != nil {
+		return fmt.Errorf("bad callback %q: %v", callback, err)
+	}
+	return nil
+}
+
+// signCallback returns the signature of a callback sent at the timestamp:
+// the hex encoded HMAC-SHA256 of "<timestamp>.<body>" keyed by the secret.
+// Signing the timestamp lets receivers reject replayed callbacks.
+func signCallback(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notify posts the payload of the finished job to its callback url,
+// retrying failed attempts, and records whether it was delivered
+func (j *jobRunner) notify(ctx context.Context, job *Job) {
+	payload := callbackPayload{
+		ID:       job.ID,
+		Kind:     job.Kind,
+		State:    job.State,
+		Error:    job.Error,
+		Search:   job.Search,
+		Created:  job.Created,
+		Finished: job.Updated,
+		URL:      "/v1/jobs/" + job.ID,
+	}
+	if job.Result != nil {
+		payload.Count = job.Result.Count
+	}
+	if job.Kind == jobExport && job.State == jobDone {
+		payload.Archive = payload.URL + "/archive"
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.Errorf(ctx, "Failed to encode callback of job %s: %v", job.ID, err)
+		return
+	}
+
+	job.CallbackState = callbackFailed
+	backoff := callbackBackoff
+	for attempt := 1; attempt <= callbackAttempts; attempt++ {
+		retry, err := postCallback(ctx, job.Callback, body)
+		if err == nil {
+			job.CallbackState = callbackDelivered
+			break
+		}
+		logger.Errorf(ctx, "Callback %d of job %s failed: %v", attempt, job.ID, err)
+		if !retry || attempt == callbackAttempts {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return
+		}
+	}
+	j.update(ctx, job)
+}
+
+// postCallback posts the body to the callback url, reporting whether a
+// failed attempt is worth retrying
+func postCallback(ctx context.Context, callback string, body []byte) (bool, error) {
+	// notify runs outside any request, so without a timeout a receiver
+	// which never responds would hold the job forever
+	ctx, cancel := context.WithTimeout(ctx, callbackTimeout)
+	defer cancel()
+
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequest(http.MethodPost, callback, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", "sha256="+signCallback(config.WebhookSecret, timestamp, body))
+
+	// redirects are not followed, as they could lead anywhere
+	client := *callbackClient(ctx)
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return false, nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return true, fmt.Errorf("%s: %s", callback, res.Status)
+	default:
+		return false, fmt.Errorf("%s: %s", callback, res.Status)
+	}
+}
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// withCallbackConfig sets up the config for callbacks to local test servers
+// and fast retries, returning a func restoring them
+func withCallbackConfig() func() {
+	saved, attempts, backoff, timeout := config, callbackAttempts, callbackBackoff, callbackTimeout
+	c := *config
+	c.WebhookSecret = "secret"
+	c.CallbackHosts = []string{"127.0.0.1"}
+	config = &c
+	callbackAttempts, callbackBackoff, callbackTimeout = 3, time.Millisecond, 100*time.Millisecond
+	return func() {
+		config, callbackAttempts, callbackBackoff, callbackTimeout = saved, attempts, backoff, timeout
+	}
+}
+
+// notifyJob notifies the callback url of a finished job, returning the
+// job as stored afterwards
+func notifyJob(t *testing.T, callback string) *Job {
+	ctx := context.Background()
+	runner := newJobRunner(newMemoryJobStore())
+	job := &Job{ID: "job", Kind: jobImages, State: jobDone, Callback: callback, CallbackState: callbackPending}
+	if err := runner.store.Put(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	runner.notify(ctx, job)
+	stored, err := runner.store.Get(ctx, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func TestNotifyDelivered(t *testing.T) {
+	defer withCallbackConfig()()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get("X-Webhook-Timestamp"), 10, 64)
+		if r.Header.Get("X-Webhook-Signature") != "sha256="+signCallback("secret", timestamp, body) {
+			t.Errorf("bad signature %q", r.Header.Get("X-Webhook-Signature"))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	if job := notifyJob(t, server.URL); job.CallbackState != callbackDelivered {
+		t.Errorf("got callback state %q, want %q", job.CallbackState, callbackDelivered)
+	}
+}
+
+func TestNotifyRetriesServerErrors(t *testing.T) {
+	defer withCallbackConfig()()
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	if job := notifyJob(t, server.URL); job.CallbackState != callbackDelivered {
+		t.Errorf("got callback state %q, want %q", job.CallbackState, callbackDelivered)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Errorf("got %d attempts, want 3", n)
+	}
+}
+
+func TestNotifyHangingReceiver(t *testing.T) {
+	defer withCallbackConfig()()
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	done := make(chan *Job)
+	go func() { done <- notifyJob(t, server.URL) }()
+	select {
+	case job := <-done:
+		if job.CallbackState != callbackFailed {
+			t.Errorf("got callback state %q, want %q", job.CallbackState, callbackFailed)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("notify did not give up on a receiver which never responds")
+	}
+}
+
+func TestValidateCallback(t *testing.T) {
+	defer withCallbackConfig()()
+	ctx := context.Background()
+	tests := []struct {
+		hosts    []string
+		callback string
+		ok       bool
+	}{
+		{[]string{"127.0.0.1"}, "http://127.0.0.1:8080/hook", true},
+		{[]string{"example.com"}, "https://hooks.example.com/job", true},
+		{[]string{"example.com"}, "http://127.0.0.1/hook", false},
+		{nil, "http://127.0.0.1/hook", false},
+		{nil, "http://169.254.169.254/computeMetadata/v1/", false},
+		{nil, "http://[::1]/hook", false},
+		{nil, "ftp://203.0.113.1/hook", false},
+	}
+	for _, test := range tests {
+		config.CallbackHosts = test.hosts
+		if err := validateCallback(ctx, test.callback); (err == nil) != test.ok {
+			t.Errorf("%s with hosts %v: got error %v, want ok %v", test.callback, test.hosts, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/golang/geo/s2"
+)
+
+// ParseWKT parses a WKT POLYGON or MULTIPOLYGON, optionally prefixed by
+// an SRID as in EWKT, returning the vertices of all its rings like
+// ParsePolyFile. Z and M coordinates are ignored. As in Simple Features,
+// outer rings are expected counter clockwise and holes clockwise.
+func ParseWKT(reader io.Reader) ([][]s2.Point, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimSpace(string(data))
+	if strings.HasPrefix(strings.ToUpper(text), "SRID=") {
+		i := strings.Index(text, ";")
+		if i < 0 {
+			return nil, fmt.Errorf("wkt: SRID without a geometry")
+		}
+		if srid := strings.TrimSpace(text[5:i]); srid != "4326" {
+			return nil, fmt.Errorf("wkt: unsupported SRID %s, expected 4326", srid)
+		}
+		text = text[i+1:]
+	}
+
+	p := &wktParser{text: text}
+	var rings []windingRing
+	switch keyword := p.keyword(); keyword {
+	case "POLYGON":
+		p.dimensions()
+		rings, err = p.polygon()
+	case "MULTIPOLYGON":
+		p.dimensions()
+		rings, err = p.multiPolygon()
+	default:
+		err = fmt.Errorf("unsupported geometry %q, expected a polygon", keyword)
+	}
+	if err == nil && p.skipSpace() < len(p.text) {
+		err = p.errorf("unexpected %q after the geometry", p.text[p.pos:])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("wkt: %v", err)
+	}
+	return orientRings(rings)
+}
+
+// wktParser is a recursive descent parser of WKT polygons
+type wktParser struct {
+	text string
+	pos  int
+}
+
+func (p *wktParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// skipSpace advances past any white space, returning the new position
+func (p *wktParser) skipSpace() int {
+	for p.pos < len(p.text) && unicode.IsSpace(rune(p.text[p.pos])) {
+		p.pos++
+	}
+	return p.pos
+}
+
+// keyword reads a word of letters, in upper case
+func (p *wktParser) keyword() string {
+	start := p.skipSpace()
+	for p.pos < len(p.text) && unicode.IsLetter(rune(p.text[p.pos])) {
+		p.pos++
+	}
+	return strings.ToUpper(p.text[start:p.pos])
+}
+
+// dimensions skips the Z, M or ZM following a geometry type, if any
+func (p *wktParser) dimensions() {
+	pos := p.pos
+	if dims := p.keyword(); dims != "Z" && dims != "M" && dims != "ZM" {
+		p.pos = pos
+	}
+}
+
+// expect reads the given character, or fails
+func (p *wktParser) expect(c byte) error {
+	if p.skipSpace() >= len(p.text) || p.text[p.pos] != c {
+		return p.errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+// next reports whether the list being read continues, reading its
+// separating comma or closing parenthesis
+func (p *wktParser) next() (bool, error) {
+	if p.skipSpace() < len(p.text) {
+		switch p.text[p.pos] {
+		case ',':
+			p.pos++
+			return true, nil
+		case ')':
+			p.pos++
+			return false, nil
+		}
+	}
+	return false, p.errorf("expected ',' or ')'")
+}
+
+// empty reads the EMPTY keyword, if present
+func (p *wktParser) empty() bool {
+	pos := p.pos
+	if p.keyword() == "EMPTY" {
+		return true
+	}
+	p.pos = pos
+	return false
+}
+
+// multiPolygon reads ((ring, ...), (ring, ...))
+func (p *wktParser) multiPolygon() ([]windingRing, error) {
+	if p.empty() {
+		return nil, nil
+	}
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	rings := make([]windingRing, 0)
+	for more := true; more; {
+		polygon, err := p.polygon()
+		if err != nil {
+			return nil, err
+		}
+		rings = append(rings, polygon...)
+		if more, err = p.next(); err != nil {
+			return nil, err
+		}
+	}
+	return rings, nil
+}
+
+// polygon reads ((x y, ...), (x y, ...)), the outer ring followed by holes
+func (p *wktParser) polygon() ([]windingRing, error) {
+	if p.empty() {
+		return nil, nil
+	}
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	rings := make([]windingRing, 0)
+	for more := true; more; {
+		ring, err := p.ring()
+		if err != nil {
+			return nil, err
+		}
+		rings = append(rings, windingRing{points: ring, hole: len(rings) > 0})
+		if more, err = p.next(); err != nil {
+			return nil, err
+		}
+	}
+	return rings, nil
+}
+
+// ring reads (x y, x y, ...), with x the longitude and y the latitude
+func (p *wktParser) ring() ([]s2.Point, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	ring := make([]s2.Point, 0)
+	for more := true; more; {
+		coords := make([]float64, 0, 4)
+		for p.skipSpace() < len(p.text) && !strings.ContainsRune(",)", rune(p.text[p.pos])) {
+			start := p.pos
+			for p.pos < len(p.text) && !unicode.IsSpace(rune(p.text[p.pos])) &&
+				!strings.ContainsRune(",)", rune(p.text[p.pos])) {
+				p.pos++
+			}
+			c, err := strconv.ParseFloat(p.text[start:p.pos], 64)
+			if err != nil {
+				return nil, p.errorf("bad coordinate %q", p.text[start:p.pos])
+			}
+			coords = append(coords, c)
+		}
+		if len(coords) < 2 || len(coords) > 4 {
+			return nil, p.errorf("expected 2 to 4 coordinates, got %d", len(coords))
+		}
+		point, err := pointFromLngLat(coords[0], coords[1])
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		ring = append(ring, point)
+		if more, err = p.next(); err != nil {
+			return nil, err
+		}
+	}
+	return ring, nil
+}